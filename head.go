@@ -47,16 +47,18 @@ func main() {
 		log.Fatal("Failed to obtain total number of records for: ", fname)
 	}
 
-	var i uint16
-
-	for i = 0; i < num_recs; i++ {
-		if i < uint16(k) {
-			var record rfslib.Record
-			err := rfs.ReadRec(fname, i, &record)
-			if err != nil {
-				log.Fatalf("Failed to obtain record %d for %s\n", i, fname)
-			}
-			fmt.Println(string(record[:]))
-		}
+	if num_recs == 0 || k <= 0 {
+		return
+	}
+	count := num_recs
+	if k < int(num_recs) {
+		count = uint16(k)
+	}
+	records, err := rfs.ReadRecs(fname, 0, count)
+	if err != nil {
+		log.Fatalf("Failed to obtain records 0 to %d for %s\n", count-1, fname)
+	}
+	for _, record := range records {
+		fmt.Println(string(record[:]))
 	}
 }
@@ -1,23 +1,40 @@
 package main
 
 import (
+	"./rfslib"
 	"bufio"
 	"bytes"
-	"crypto/md5"
+	"context"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/sha3"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/big"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/crypto/blake2b"
 )
 
 type configSetting struct {
@@ -35,6 +52,13 @@ type configSetting struct {
 	IncomingMinersAddr     string
 	OutgoingMinersIP       string
 	IncomingClientsAddr    string
+	BlockStoreDir          string
+	KeyFile                string
+	HashFunction           string // sha256 (default), sha3 or blake2b
+	TargetBlockInterval    int    // seconds between blocks the difficulty aims at, fixed difficulty if 0
+	RetargetBlocks         int    // blocks between two difficulty adjustments, 10 if 0
+	MiningThreads          int    // goroutines mining a block, the number of CPUs if 0
+	TargetPeers            int    // outbound peers the miner keeps, 8 if 0
 }
 type ClientHandle int
 type MinerHandle int
@@ -43,28 +67,27 @@ type ClientMsg struct {
 	MinerID   string
 }
 type OpMsg struct {
-	MinerID string
-	MsgID   uint
-	Op      string
-	Name    string
-	Content string
+	MinerID   string
+	ID        string // random 128 bit hex, unique across miners and restarts
+	Op        string
+	Name      string
+	Content   []byte
+	Signature []byte // ed25519 signature of the operation by the key of MinerID
 }
+
 type Record [512]byte
 
 var config configSetting
-var globalMsgID uint
 var blockFile map[string]string /*创建集合 */
+var blockFileMutex sync.Mutex   // client requests run concurrently
 var recordQueue []*OpMsg
 var recordQueueMutex sync.Mutex
 var recordTrash []*OpMsg
 var recordTrashMutex sync.Mutex
 
-var blockQueue []*Block
-var blockQueueMutex sync.Mutex
-
 var minerChain *BlockChain
-var hasSynchronize bool
-var synTempQueue []*Block
+var hasSynchronize bool            // the startup sync is over, until then flooded blocks are parked
+var synTempQueue []*FloodBlockArgs // blocks flooded during the startup sync
 var synQueueMutex sync.Mutex
 
 // type filenode struct {
@@ -101,83 +124,57 @@ func readFileByte(filePath string) []byte {
 	return data
 }
 
-func checkfile(fname string) bool {
+// the canonical tip, every query and every mined block uses it
+func longestTip() *BlockNode {
 	longestMutex.Lock()
-	lastblock := longestChainNodes[rand.Int()%len(longestChainNodes)]
-	longestMutex.Unlock()
+	defer longestMutex.Unlock()
+	return canonicalTip
+}
 
-	for {
-		if lastblock == nil {
-			return false
-		}
-		if strings.Contains(lastblock.block.Transactions, "CreateFile"+"{,}"+fname) == true {
-			return true
-		}
-		lastblock = lastblock.parent
+// go back confirms blocks from node, nil if the chain is not that long
+func confirmedNode(node *BlockNode, confirms int) *BlockNode {
+	for i := 0; i < confirms && node != nil; i++ {
+		node = node.parent
 	}
-	return false
+	return node
 }
 
-func getAllRecordByName(fname string) []string {
-	longestMutex.Lock()
-	lastblock := longestChainNodes[rand.Int()%len(longestChainNodes)]
-	longestMutex.Unlock()
-	res := make([]string, 0)
+// a file exists as soon as its CreateFile is in the longest chain
+func checkfile(fname string) bool {
+	return longestTip().files.file(fname) != nil
+}
 
-	for i := 0; i < config.ConfirmsPerFileAppend; i++ {
-		if lastblock == nil {
-			return res
-		}
-		lastblock = lastblock.parent
+// the file as of ConfirmsPerFileAppend blocks before the tip, so that it only has
+// confirmed records. Returns nil if the file is not there yet.
+func getConfirmedFile(fname string) *fileEntry {
+	node := confirmedNode(longestTip(), config.ConfirmsPerFileAppend)
+	if node == nil {
+		return nil
 	}
+	return node.files.file(fname)
+}
 
-	for {
-		if lastblock == nil {
-			return res
-		}
-		if strings.Contains(lastblock.block.Transactions, "AppendRec"+"{,}"+fname) == true {
-			jsons := convertJsonArray(lastblock.block.Transactions)
-			for _, json := range jsons {
-				if json["op"] == "AppendRec" && json["filename"] == fname {
-					res = append(res, json["content"])
-				}
-			}
-		}
-		lastblock = lastblock.parent
+// number of confirmed records of the file
+func confirmedNumRecs(fname string) int {
+	if entry := getConfirmedFile(fname); entry != nil {
+		return entry.numRecs
 	}
-	return res
+	return 0
 }
 
-func getFileList() string {
-	res := ""
-
-	longestMutex.Lock()
-	lastblock := longestChainNodes[rand.Int()%len(longestChainNodes)]
-	longestMutex.Unlock()
-
-	for {
-		if lastblock == nil {
-			break
-		}
-		if strings.Contains(lastblock.block.Transactions, "CreateFile") == true {
-			jsons := convertJsonArray(lastblock.block.Transactions)
-			for _, json := range jsons {
-				if json["op"] == "CreateFile" {
-					if len(res) == 0 {
-						res += json["filename"]
-					} else {
-						res += ";" + json["filename"]
-					}
-				}
-			}
-		}
-		lastblock = lastblock.parent
+// names of the files in the longest chain, the newest first
+func getFileList() []string {
+	res := make([]string, 0)
+	for name := longestTip().files.names; name != nil; name = name.next {
+		res = append(res, name.name)
 	}
 	return res
 }
 
 func showfiles() {
 	println("------------------------")
+	blockFileMutex.Lock()
+	defer blockFileMutex.Unlock()
 	for k, v := range blockFile {
 		fmt.Printf("Name:%s  Length:%d\n", k, len(v))
 		for i := 0; i*512 < len(v); i++ {
@@ -187,78 +184,102 @@ func showfiles() {
 	println("------------------------")
 }
 
-func hashOpMsg(opmsg *OpMsg) (hashStr string) {
-	recordQueueMutex.Lock()
-	str := opmsg.Content + opmsg.MinerID + opmsg.Name + opmsg.Op
-	hash := md5.New()
-	hash.Write([]byte(str))
-	hashStr = hex.EncodeToString(hash.Sum(nil))
-	return hashStr
-}
-
-func checkOpHashMap(a string, list []string) bool {
-	for _, b := range list {
-		if b == a {
-			return true
-		}
-	}
-	return false
-}
-
-var OpHashMap []string
-
 /*******************************************/
 // Queue Opearation
 
 func pushRecordQueue(opmsg *OpMsg) {
+	recordQueueMutex.Lock()
+	defer recordQueueMutex.Unlock()
 	for _, q := range recordQueue {
 		if q.Op == "CreateFile" && opmsg.Op == "CreateFile" && q.Name == opmsg.Name {
 			return
 		}
+		if q.MinerID == opmsg.MinerID && q.ID == opmsg.ID {
+			return
+		}
 	}
-	recordQueueMutex.Lock()
 	recordQueue = append(recordQueue, opmsg)
-	recordQueueMutex.Unlock()
 }
 
 func popRecordQueue() *OpMsg {
-	if len(recordQueue) == 0 {
-		return nil
-	}
-	head := recordQueue[0]
+	return popRecordQueueIf(nil)
+}
+
+// popRecordQueueIf pops the first operation of recordQueue which accept takes, nil if
+// there is none. The operations accept refuses stay queued in their order, so one of
+// them can't hold up the ones behind it. Operations requeued meanwhile can't be lost.
+func popRecordQueueIf(accept func(record *OpMsg) bool) *OpMsg {
 	recordQueueMutex.Lock()
-	recordQueue = recordQueue[1:]
+	for i, record := range recordQueue {
+		if accept != nil && !accept(record) {
+			continue
+		}
+		recordQueue = append(recordQueue[:i:i], recordQueue[i+1:]...)
+		recordQueueMutex.Unlock()
+		recordTrashMutex.Lock()
+		recordTrash = append(recordTrash, record)
+		recordTrashMutex.Unlock()
+		return record
+	}
 	recordQueueMutex.Unlock()
-	recordTrashMutex.Lock()
-	recordTrash = append(recordTrash, head)
-	recordTrashMutex.Unlock()
-	return head
+	return nil
+}
+
+// put operations back at the head of recordQueue, in the given order, unless they are already queued
+func requeueRecords(records []*OpMsg) {
+	recordQueueMutex.Lock()
+	defer recordQueueMutex.Unlock()
+	requeued := make([]*OpMsg, 0, len(records)+len(recordQueue))
+	for _, record := range records {
+		queued := false
+		for _, q := range recordQueue {
+			if q.MinerID == record.MinerID && q.ID == record.ID {
+				queued = true
+				break
+			}
+		}
+		if !queued {
+			requeued = append(requeued, record)
+		}
+	}
+	recordQueue = append(requeued, recordQueue...)
+}
+
+// operations which can never be in a block any more, with the reason
+var rejectedOps = make(map[string]rfslib.ErrorCode)
+var rejectedOpsMutex sync.Mutex
+
+func opKey(record *OpMsg) string {
+	return record.MinerID + "/" + record.ID
 }
 
-func pushBlockQueue(block *Block) {
-	blockQueueMutex.Lock()
-	blockQueue = append(blockQueue, block)
-	blockQueueMutex.Unlock()
+func rejectOperation(record *OpMsg, code rfslib.ErrorCode) {
+	printColorFont("red", "Reject "+record.Op+" "+record.Name+" of "+opKey(record)+": "+code.String())
+	rejectedOpsMutex.Lock()
+	rejectedOps[opKey(record)] = code
+	rejectedOpsMutex.Unlock()
 }
 
-func popBlockQueue() *Block {
-	if len(blockQueue) == 0 {
-		return nil
-	}
-	head := blockQueue[0]
-	blockQueue = blockQueue[1:]
-	return head
+func operationRejected(record *OpMsg) (rfslib.ErrorCode, bool) {
+	rejectedOpsMutex.Lock()
+	defer rejectedOpsMutex.Unlock()
+	code, ok := rejectedOps[opKey(record)]
+	return code, ok
 }
 
 // In order to avoid message flooding in loop network
 func checkOperationInQueue(msg *OpMsg) bool {
+	recordQueueMutex.Lock()
+	defer recordQueueMutex.Unlock()
+	recordTrashMutex.Lock()
+	defer recordTrashMutex.Unlock()
 	for i := 0; i < len(recordQueue); i++ {
-		if recordQueue[i].MinerID == msg.MinerID && recordQueue[i].MsgID == msg.MsgID {
+		if recordQueue[i].MinerID == msg.MinerID && recordQueue[i].ID == msg.ID {
 			return true
 		}
 	}
 	for i := 0; i < len(recordTrash); i++ {
-		if recordTrash[i].MinerID == msg.MinerID && recordTrash[i].MsgID == msg.MsgID {
+		if recordTrash[i].MinerID == msg.MinerID && recordTrash[i].ID == msg.ID {
 			return true
 		}
 	}
@@ -266,39 +287,16 @@ func checkOperationInQueue(msg *OpMsg) bool {
 }
 
 // In order to avoid message flooding in loop network
-func checkBlockInQueue(block *Block) bool {
-	for i := 0; i < len(blockQueue); i++ {
-		if blockQueue[i].Nonce == block.Nonce && blockQueue[i].PrevHash == block.PrevHash {
-			return true
-		}
-	}
-	return false
+func checkBlockInTree(block *Block) bool {
+	return lookupNode(minerChain.hashBlock(block)) != nil
 }
 
 func printRecordQueue() {
 	println("---------------------------\nRecordQueue")
+	recordQueueMutex.Lock()
+	defer recordQueueMutex.Unlock()
 	for i := 0; i < len(recordQueue); i++ {
-		println(recordQueue[i].MinerID, recordQueue[i].Op, recordQueue[i].Name, recordQueue[i].Content)
-	}
-	println("---------------------------")
-}
-
-func printBlockQueue() {
-	println("---------------------------\nBlockQueue")
-	for i := 0; i < len(blockQueue); i++ {
-		println("***", i)
-		block := blockQueue[i]
-		println("Repeated: False")
-		println("pre-Hash:", block.PrevHash)
-		println("index", block.Index)
-		println("MinerID", block.Miner)
-		println("Transactions:")
-		jsons := convertJsonArray(block.Transactions)
-		for i := 0; i < len(jsons); i++ {
-			json := jsons[i]
-			fmt.Printf("%d\top:%s\tfilename:%s\tcontent:%s\n", i, json["op"], json["filename"], json["content"])
-		}
-		println("timestamp", block.Timestamp)
+		println(recordQueue[i].MinerID, recordQueue[i].Op, recordQueue[i].Name, string(recordQueue[i].Content))
 	}
 	println("---------------------------")
 }
@@ -348,22 +346,16 @@ func listenMiner() {
 }
 
 // generate a opeation message struct
-func generateOpMsg(op string, name string, Content string) OpMsg {
-	operationMsg := OpMsg{config.MinerID, globalMsgID, op, name, Content}
-	globalMsgID++
+func generateOpMsg(op string, name string, Content []byte) OpMsg {
+	operationMsg := OpMsg{config.MinerID, newOperationID(), op, name, Content, nil}
+	signOperation(&operationMsg)
 	return operationMsg
 }
 
 // just a demo
 func sendMiner(remoteIPPort string, args ClientMsg) {
-	client, err := rpc.DialHTTP("tcp", remoteIPPort)
-	if err != nil {
-		log.Fatal("dialing:", err)
-	}
-	defer client.Close()
-	// Synchronous call
 	var reply int
-	err = client.Call("MinerHandle.MinerTalk", args, &reply)
+	err := callPeer(remoteIPPort, "MinerHandle.MinerTalk", args, &reply)
 	if err != nil {
 		log.Fatal("tcp error:", err)
 	}
@@ -376,119 +368,112 @@ func sendMiner(remoteIPPort string, args ClientMsg) {
 // RPC Handler
 
 // FloodOperation : flood operation of client to the whole network
-func (t *MinerHandle) FloodOperation(record *OpMsg, reply *int) error {
+func (t *MinerHandle) FloodOperation(args *FloodOperationArgs, reply *int) error {
+	if err := checkNetworkID(args.NetworkID); err != nil {
+		return err
+	}
+	record := &args.Op
 	*reply = 0
+	if verifyOperation(record) == false {
+		printColorFont("red", "Drop operation "+opKey(record)+": bad signature")
+		return nil
+	}
+	if err := checkOperationSize(record.Op, record.Name, record.Content); err != nil {
+		printColorFont("red", "Drop operation "+opKey(record)+": "+err.Error())
+		return nil
+	}
 	if checkOperationInQueue(record) == false {
 		println("------------")
-		println("| Got a Record: ", record.MinerID, record.MsgID, record.Op, record.Name, record.Content)
+		println("| Got a Record: ", record.MinerID, record.ID, record.Op, record.Name, string(record.Content))
 		printColorFont("green", "| pushed into recordQueue")
 		println("------------")
 		pushRecordQueue(record)
 		// minerChain.createTransaction(record.Op, record.Name, record.Content, record.MinerID)
-		broadcastOperations(*record)
+		go broadcastOperations(*record)
 	}
 	return nil
 }
 
+// FloodOperationArgs : a flooded operation
+type FloodOperationArgs struct {
+	Op        OpMsg
+	NetworkID string // network of the sender, operations of another network are refused
+}
+
+// FloodBlockArgs : a flooded block and the miner it comes from
+type FloodBlockArgs struct {
+	Block     Block
+	From      string // IncomingMinersAddr of the sender
+	NetworkID string // network of the sender, blocks of another network are refused
+}
+
 // FloodBlock : flood block to the whole network
-func (t *MinerHandle) FloodBlock(block *Block, reply *int) error {
+func (t *MinerHandle) FloodBlock(args *FloodBlockArgs, reply *int) error {
+	if err := checkNetworkID(args.NetworkID); err != nil {
+		return err
+	}
+	block := &args.Block
+	synQueueMutex.Lock()
 	if hasSynchronize == false {
-		synQueueMutex.Lock()
-		synTempQueue = append(synTempQueue, block)
+		synTempQueue = append(synTempQueue, args)
 		synQueueMutex.Unlock()
 		return nil
 	}
+	synQueueMutex.Unlock()
 	*reply = 0
 	// println(getTime())
 	// printColorFont("purple", "*** Receive Block")
 	// println(block.Index)
-
-	if checkBlockInQueue(block) == false {
-		if minerChain.verifyBlock(block) == false {
-			return nil
-		}
-		println("------------ Verified & Added Block -------")
-		// println("Repeated: False")
-		println("pre-Hash:", block.PrevHash)
-		println("index:", block.Index)
-		println("MinerID:", block.Miner)
-		// // println("tx", block.Transactions)
-		// println("Transactions:")
-		// if block.Transactions != "" {
-		// 	jsons := convertJsonArray(block.Transactions)
-		// 	for i := 0; i < len(jsons); i++ {
-		// 		json := jsons[i]
-		// 		fmt.Printf("%d\top:%s\tfilename:%s\tcontent:%s\n", i, json["op"], json["filename"], json["content"])
-		// 	}
-		// }
-		// println("timestamp:", block.Timestamp)
-		println("------------")
-		// println()
-		pushBlockQueue(block)
-
-		// minerChain.addBlockToChain(block) //old way
-
-		root.addChild(*block) // new way
-
-		broadcastBlocks(block)
-
-	}
+	receiveBlock(block, args.From)
 	return nil
 }
 
-func tranverseTree(targetIp string, node *BlockNode) {
-	sendTreeNode(targetIp, node.block)
-	for _, child := range node.blockChildren {
-		tranverseTree(targetIp, child)
+// receiveBlock verifies a block from the peer from, adds it to the tree and floods it further.
+// A block whose parent is unknown waits in the orphan pool while the sync manager catches up.
+func receiveBlock(block *Block, from string) {
+	if checkBlockInTree(block) == true {
+		return
 	}
-}
-
-func (t *MinerHandle) AskForTree(targetIp string, reply *bool) error {
-	for {
-		for _, child := range root.blockChildren {
-			tranverseTree(targetIp, child)
+	if lookupNode(block.PrevHash) == nil {
+		if minerChain.checkProofOfWork(block, powLimit()) && verifyBlockSignature(block) && addOrphan(*block, from) {
+			printColorFont("purple", "Orphan block "+strconv.Itoa(block.Index)+" from "+from+", syncing for "+block.PrevHash)
+			requestSync(from)
 		}
-		*reply = true
-		return nil
+		return
 	}
-	return nil
-}
-
-func (t *MinerHandle) ReceiveTree(block Block, reply *bool) error {
-	if checkBlockInQueue(&block) == false {
-		println("---------------")
-		println("| Index:", block.Index)
-		println("| Miner:", block.Miner)
-		println("| Nonce:", block.Nonce)
-		println("| PrevHash:", block.PrevHash)
-		println("| Transactions:", block.Transactions)
-		println("| Timestamp:", block.Timestamp)
-		println("---------------")
-		println()
-		pushBlockQueue(&block)
-		root.addChild(block)
+	if minerChain.verifyBlock(block) == false {
+		return
 	}
-	*reply = true
-	return nil
+	node := root.addChild(*block)
+	if node == nil {
+		return // another peer sent the same block meanwhile
+	}
+	println("------------ Verified & Added Block -------")
+	// println("Repeated: False")
+	println("pre-Hash:", block.PrevHash)
+	println("index:", block.Index)
+	println("MinerID:", block.Miner)
+	// // println("tx", block.Transactions)
+	// println("Transactions:")
+	// for i, tx := range block.Transactions {
+	// 	fmt.Printf("%d\top:%s\tfilename:%s\tcontent:%s\n", i, tx.Op, tx.FileName, tx.Content)
+	// }
+	// println("timestamp:", block.Timestamp)
+	println("------------")
+	// println()
+
+	broadcastBlocks(block)
+	adoptOrphans(node.hashvalue)
 }
 
-func sendTreeNode(ip string, block Block) error {
-	client, err := rpc.DialHTTP("tcp", ip)
-	if err != nil {
-		println("1 Send block dialing:", err)
-		return err
-	}
-	defer client.Close()
-	var reply bool
-	err = client.Call("MinerHandle.ReceiveTree", block, &reply)
-	if err != nil {
-		println("2 Send block dialing:", err)
-		return err
+// GetBlock : the block with the given hash, an error if this miner does not have it
+func (t *MinerHandle) GetBlock(hash string, reply *Block) error {
+	node := lookupNode(hash)
+	if node == nil {
+		return fmt.Errorf("no block %s", hash)
 	}
-	if reply == true {
-		return nil
-	}
-	return err
+	*reply = node.block
+	return nil
 }
 
 /******************************************/
@@ -503,17 +488,11 @@ func broadcastOperations(operationMsg OpMsg) {
 			}
 		}
 	}
-	for _, ip := range config.PeerMinersAddrs {
-		client, err := rpc.DialHTTP("tcp", ip)
-		if err != nil {
-			// println("dialing:", err)
-			continue
-		}
-		defer client.Close()
+	for _, ip := range peerAddrs() {
 		var reply int
-		err = client.Call("MinerHandle.FloodOperation", operationMsg, &reply)
+		err := callPeer(ip, "MinerHandle.FloodOperation", FloodOperationArgs{operationMsg, networkID()}, &reply)
 		if err != nil {
-			println("tcp error:", err)
+			reportPeerError(ip, "FloodOperation", err)
 			continue
 		}
 		// if reply == 0 {
@@ -530,17 +509,11 @@ func broadcastBlocks(block *Block) {
 	// println("Transactions:", block.Transactions)
 	// println("Timestamp:", block.Timestamp)
 
-	for _, ip := range config.PeerMinersAddrs {
-		client, err := rpc.DialHTTP("tcp", ip)
-		if err != nil {
-			//println("dialing:", err)
-			continue
-		}
-		defer client.Close()
+	for _, ip := range peerAddrs() {
 		var reply int
-		err = client.Call("MinerHandle.FloodBlock", block, &reply)
+		err := callPeer(ip, "MinerHandle.FloodBlock", FloodBlockArgs{*block, config.IncomingMinersAddr, networkID()}, &reply)
 		if err != nil {
-			println("tcp error:", err)
+			reportPeerError(ip, "FloodBlock", err)
 			continue
 		}
 		// if reply == 0 {
@@ -551,216 +524,1270 @@ func broadcastBlocks(block *Block) {
 	println()
 }
 
-func synchronization() {
-	println("******** Synchronization Receive block ***********")
-	for _, ip := range config.PeerMinersAddrs {
-		client, err := rpc.DialHTTP("tcp", ip)
-		if err != nil {
-			println("synchronization dialing error:", err)
-			continue
-		}
-		defer client.Close()
-		var reply bool
-		err = client.Call("MinerHandle.AskForTree", config.IncomingMinersAddr, &reply)
-		if err != nil {
-			println("synchronization client call AskForTree error:", err)
-			continue
+/*** Chain Sync ***/
+
+// A miner catches up by pulling from its peers, headers first. It sends a block locator,
+// the hashes of its canonical chain from the tip back to the genesis block, further and
+// further apart, and the peer answers with the headers of its canonical chain after the
+// newest locator block it has. Once the headers link up and carry valid proof of work
+// and signatures, the bodies are fetched in batches from every peer at once and added to
+// the tree in order. Every added block is in the block store, so a sync that is cut off
+// resumes from there. The tip is the chain with the most work, not the longest, so the
+// run of every peer is fetched and the tree picks. Each peer is asked next from the end
+// of its last run.
+
+const maxHeadersPerReply = 2000
+const maxBlocksPerBatch = 64
+
+// HeadersRequest : a miner asks for the headers after its block locator
+type HeadersRequest struct {
+	NetworkID string
+	Locator   []string
+}
+
+// BlocksRequest : a miner asks for the blocks with the given hashes
+type BlocksRequest struct {
+	NetworkID string
+	Hashes    []string
+}
+
+// GetHeaders : the headers of the canonical chain after the newest locator block on it,
+// after the genesis block if there is none
+func (t *MinerHandle) GetHeaders(request HeadersRequest, reply *[]BlockHeader) error {
+	if err := checkNetworkID(request.NetworkID); err != nil {
+		return err
+	}
+	tip := longestTip()
+	fork := &root
+	for _, hash := range request.Locator {
+		if node := lookupNode(hash); node != nil && commonAncestor(node, tip) == node {
+			fork = node
+			break
 		}
+	}
+	chain := make([]*BlockNode, 0)
+	for node := tip; node != fork; node = node.parent {
+		chain = append(chain, node)
+	}
+	headers := make([]BlockHeader, 0)
+	for i := len(chain) - 1; i >= 0 && len(headers) < maxHeadersPerReply; i-- {
+		headers = append(headers, chain[i].block.header())
+	}
+	*reply = headers
+	return nil
+}
 
-		if reply == true {
-			hasSynchronize = true
-			for _, block := range synTempQueue {
-				if checkBlockInQueue(block) == true {
-					pushBlockQueue(block)
-					root.addChild(*block)
-				}
-			}
-			break;
+// GetBlocks : the blocks with the given hashes, an error if this miner misses one
+func (t *MinerHandle) GetBlocks(request BlocksRequest, reply *[]Block) error {
+	if err := checkNetworkID(request.NetworkID); err != nil {
+		return err
+	}
+	if len(request.Hashes) > maxBlocksPerBatch {
+		return fmt.Errorf("asked for %d blocks, at most %d per batch", len(request.Hashes), maxBlocksPerBatch)
+	}
+	blocks := make([]Block, 0, len(request.Hashes))
+	for _, hash := range request.Hashes {
+		node := lookupNode(hash)
+		if node == nil {
+			return fmt.Errorf("no block %s", hash)
 		}
+		blocks = append(blocks, node.block)
 	}
-	println("******** End Synchronization Receive block *******")
+	*reply = blocks
+	return nil
 }
 
-func checkPeers()(connected bool){
-	numDisconnected := 0
-	for _, ip := range config.PeerMinersAddrs {
-		_, err := rpc.DialHTTP("tcp", ip)
-		if err != nil {
-			numDisconnected++
+// blockLocator : the hashes of the chain at tip, the 10 blocks before it one by one, then
+// with the gap doubling each time, always ending with the genesis block
+func blockLocator(tip *BlockNode) []string {
+	locator := make([]string, 0, 32)
+	step := 1
+	for node := tip; ; {
+		locator = append(locator, node.hashvalue)
+		if node.parent == nil {
+			return locator
+		}
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		for i := 0; i < step && node.parent != nil; i++ {
+			node = node.parent
 		}
 	}
-	// check if anyone is connected
-	if numDisconnected == len(config.PeerMinersAddrs) {
-		return false
+}
+
+// checkHeaders : the headers follow each other from a block in the tree, each with a
+// valid proof of work and signature. Returns their hashes.
+func checkHeaders(headers []BlockHeader) ([]string, error) {
+	parent := lookupNode(headers[0].PrevHash)
+	if parent == nil {
+		return nil, fmt.Errorf("first header follows unknown block %s", headers[0].PrevHash)
+	}
+	prevHash, prevIndex, prevTime := parent.hashvalue, parent.block.Index, parent.block.Timestamp
+	hashes := make([]string, len(headers))
+	for i := range headers {
+		header := &headers[i]
+		hash := hashHeader(header)
+		switch {
+		case header.PrevHash != prevHash:
+			return nil, fmt.Errorf("header %d does not follow %s", header.Index, prevHash)
+		case header.Index != prevIndex+1:
+			return nil, fmt.Errorf("header %d follows index %d", header.Index, prevIndex)
+		case header.Timestamp <= prevTime:
+			return nil, fmt.Errorf("header %d is not after its parent", header.Index)
+		case !meetsTarget(hash, powLimit()):
+			return nil, fmt.Errorf("header %d has no valid proof of work", header.Index)
+		case !verifyHeaderSignature(header):
+			return nil, fmt.Errorf("header %d has a bad signature", header.Index)
+		}
+		hashes[i] = hash
+		prevHash, prevIndex, prevTime = hash, header.Index, header.Timestamp
 	}
-	return true
+	return hashes, nil
 }
-// thread to deal with incoming message from client
-func listenClient() {
-	ipport := strings.Split(config.IncomingClientsAddr, ":")
-	ip := ipport[0]
-	port, _ := strconv.Atoi(ipport[1])
-	listen, err := net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(ip), port, ""})
-	if err != nil {
-		fmt.Println("Fail to monitor ", err.Error())
-		return
+
+// headerRuns asks every peer for the headers after from[ip], the canonical tip if it
+// has no entry, and returns the valid runs by peer without the blocks this miner
+// already has. A run of known blocks only moves from[ip] along and asks again. A peer
+// which fails the call is left out of peers.
+func headerRuns(peers map[string]bool, from map[string]*BlockNode) map[string][]string {
+	runs := make(map[string][]string)
+	for ip := range peers {
+		for {
+			start := from[ip]
+			if start == nil {
+				start = longestTip()
+			}
+			var headers []BlockHeader
+			err := callPeer(ip, "MinerHandle.GetHeaders", HeadersRequest{networkID(), blockLocator(start)}, &headers)
+			if err != nil {
+				reportPeerError(ip, "GetHeaders", err)
+				delete(peers, ip)
+				break
+			}
+			if len(headers) == 0 {
+				break
+			}
+			hashes, err := checkHeaders(headers)
+			if err != nil {
+				println("synchronization headers from", ip, "refused:", err.Error())
+				break
+			}
+			missing := make([]string, 0, len(hashes))
+			for _, hash := range hashes {
+				if lookupNode(hash) == nil {
+					missing = append(missing, hash)
+				}
+			}
+			if len(missing) > 0 {
+				runs[ip] = missing
+				break
+			}
+			last := lookupNode(hashes[len(hashes)-1])
+			if len(headers) < maxHeadersPerReply || last == from[ip] {
+				break
+			}
+			from[ip] = last
+		}
 	}
-	// fmt.Println("client port:", config.IncomingClientsAddr)
+	return runs
+}
 
-	for {
-		conn, err := listen.AcceptTCP()
-		if err != nil {
-			fmt.Println(getTime())
-			println("Exception on client:", err.Error())
-			continue
+// fetchBlocks downloads the blocks of hashes in batches, one worker per peer. A batch a
+// peer fails to serve goes back to the queue for the others, and the peer is left out.
+func fetchBlocks(peers map[string]bool, hashes []string) map[string]Block {
+	var queueMutex sync.Mutex
+	queue := make([][]string, 0)
+	for first := 0; first < len(hashes); first += maxBlocksPerBatch {
+		last := first + maxBlocksPerBatch
+		if last > len(hashes) {
+			last = len(hashes)
 		}
-		defer conn.Close()
-		go func() {
-			data := make([]byte, 1024) // data received by tcp
+		queue = append(queue, hashes[first:last])
+	}
+	bodies := make(map[string]Block)
+	var wg sync.WaitGroup
+	for ip := range peers {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
 			for {
-				i, err := conn.Read(data)
-				if err != nil {
-					break
+				queueMutex.Lock()
+				if len(queue) == 0 {
+					queueMutex.Unlock()
+					return
 				}
-				print(getTime() + ": ")
-				printColorFont("blue", "Operation: "+string(data[0:i]))
-
-				msg := data[0:i]
-				var msgjson map[string]string
-				err = json.Unmarshal(msg, &msgjson)
-				if err != nil {
-					fmt.Println("error: ", err)
+				batch := queue[0]
+				queue = queue[1:]
+				queueMutex.Unlock()
+
+				var blocks []Block
+				err := callPeer(ip, "MinerHandle.GetBlocks", BlocksRequest{networkID(), batch}, &blocks)
+				if err == nil && len(blocks) != len(batch) {
+					err = fmt.Errorf("%d blocks for %d hashes", len(blocks), len(batch))
 				}
-				fmt.Println(msgjson["op"], msgjson["name"], msgjson["content"])
-				// if !checkPeers() {
-				// 		conn.Write([]byte("AllDisconnectedPeers"))
-				// 		continue
-				// }
-				// Client CreateFile
-				if msgjson["op"] == "CreateFile" {
-					if checkfile(msgjson["name"]) == true {
-						conn.Write([]byte("FileExistsError"))
-					} else {
-						blockFile[msgjson["name"]] = "" // create a new files
-						fmt.Println("-----------------")
-						fmt.Println(msgjson)
-						fmt.Println("-----------------")
-						// codes about blockchain
-						// conn.Write([]byte("success"))
-						operationMsg := generateOpMsg(msgjson["op"], msgjson["name"], msgjson["content"])
-						conn.Write([]byte(strconv.Itoa(int(operationMsg.MsgID)) + ";" + strconv.Itoa(config.GenOpBlockTimeout) + ";" + config.MinerID))
-						pushRecordQueue(&operationMsg)
-						broadcastOperations(operationMsg)
-					}
-					// Client ListFiles
-				} else if msgjson["op"] == "ListFiles" {
-					conn.Write([]byte(getFileList()))
-					// Client TotalRecs
-				} else if msgjson["op"] == "TotalRecs" {
-					if checkfile(msgjson["name"]) == false {
-						conn.Write([]byte("FileDoesNotExistError"))
-					} else {
-						records := getAllRecordByName(msgjson["name"])
-						conn.Write([]byte(strconv.Itoa(len(records))))
-					}
-					// Client ReadRec
-				} else if msgjson["op"] == "ReadRec" {
-					pos, err := strconv.Atoi(msgjson["content"])
-					if err != nil {
-						log.Fatal("record num isn't integer")
-						continue
-					}
-					if checkfile(msgjson["name"]) == false {
-						conn.Write([]byte("FileDoesNotExistError"))
-						continue
+				for i := 0; err == nil && i < len(blocks); i++ {
+					if minerChain.hashBlock(&blocks[i]) != batch[i] {
+						err = fmt.Errorf("block %d does not match its header", blocks[i].Index)
 					}
-					records := getAllRecordByName(msgjson["name"])
-					if len(records) < pos {
-						conn.Write([]byte("RecordDoesNotExistError"))
-					} else {
-						conn.Write([]byte(records[pos]))
-					}
-					// Client AppendRec
-				} else if msgjson["op"] == "AppendRec" {
-					if checkfile(msgjson["name"]) == false {
-						conn.Write([]byte("FileDoesNotExistError"))
-						continue
-					}
-					records := getAllRecordByName(msgjson["name"])
-					if len(records) >= 65535 { // have at most 65,5354 (uint16) records
-						conn.Write([]byte("FileMaxLenReachedError"))
-					} else {
-						// codes about blockchain
-						operationMsg := generateOpMsg(msgjson["op"], msgjson["name"], msgjson["content"])
-						// retrun msgID,time interval, ConfirmsPerFileAppend, current length
-						pushRecordQueue(&operationMsg)
-						broadcastOperations(operationMsg)
-
-						queryRecord(operationMsg)
-
-						records := getAllRecordByName(msgjson["name"])
-						conn.Write([]byte(strconv.Itoa(len(records))))
-					}
-				} else if msgjson["op"] == "queryFile" {
-					tranction := msgjson["name"]
-					minerID := msgjson["content"]
-					reply := queryFilePos(tranction, minerID)
-					conn.Write([]byte(reply))
 				}
+				queueMutex.Lock()
+				if err != nil {
+					queue = append(queue, batch)
+					queueMutex.Unlock()
+					println("synchronization GetBlocks from", ip, "error:", err.Error())
+					return
+				}
+				for i, hash := range batch {
+					bodies[hash] = blocks[i]
+				}
+				queueMutex.Unlock()
 			}
-		}()
+		}(ip)
 	}
+	wg.Wait()
+	return bodies
 }
 
-func queryFilePos(transaction string, minerID string) string {
-	longestMutex.Lock()
-	lastblock := longestChainNodes[rand.Int()%len(longestChainNodes)] // pick the longest chain randomly
-	curLength := maxLength
-	longestMutex.Unlock()
-
-	for {
-		if lastblock == nil {
-			return "wait"
+// attachBlocks adds the fetched blocks to the tree in the order of hashes, up to the
+// first one missing or invalid. Returns how many it added.
+func attachBlocks(hashes []string, bodies map[string]Block) int {
+	added := 0
+	for _, hash := range hashes {
+		if lookupNode(hash) != nil {
+			continue
 		}
-		if strings.Contains(lastblock.block.Transactions, transaction) == true {
-			if strings.Contains(lastblock.block.Transactions, minerID) == false {
-				return "false"
-			}
-			if curLength-lastblock.block.Index >= config.ConfirmsPerFileCreate {
-				return "true"
-			}
+		block, ok := bodies[hash]
+		if !ok || !minerChain.verifyBlock(&block) {
+			break
+		}
+		if node := root.addChild(block); node != nil {
+			added++
+			adoptOrphans(node.hashvalue)
 		}
-		lastblock = lastblock.parent
 	}
+	return added
 }
 
-func queryRecord(record OpMsg) {
-
-	transaction := record.Op + "{,}" + record.Name + "{,}" + record.Content + "{,}" + record.MinerID + "{,}" + strconv.Itoa(int(record.MsgID))
-	ticker := time.NewTicker(time.Duration(config.GenOpBlockTimeout) * time.Second)
-	for range ticker.C {
-		longestMutex.Lock()
-		lastblock := longestChainNodes[rand.Int()%len(longestChainNodes)] // pick the longest chain randomly
-		curLength := maxLength
-		longestMutex.Unlock()
-		// println("Query")
-		// println("----------------")
-		for {
-			if lastblock == nil {
-				break
+// syncWithPeers pulls the blocks this miner is missing from its peers, returns false
+// if none of them answered
+func syncWithPeers() bool {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+	syncSourcesMutex.Lock()
+	sources := syncSources
+	syncSources = make(map[string]bool)
+	syncSourcesMutex.Unlock()
+	for ip := range sources {
+		if addPeer(ip) {
+			println("New peer", ip, "which sent an orphan block")
+		}
+	}
+	peers := make(map[string]bool)
+	for _, ip := range peerAddrs() {
+		peers[ip] = true
+	}
+	answered := false
+	from := make(map[string]*BlockNode)
+	for len(peers) > 0 {
+		runs := headerRuns(peers, from)
+		if len(peers) > 0 {
+			answered = true
+		}
+		if len(runs) == 0 {
+			break
+		}
+		// the peers which sent each block, any of them can serve it
+		holders := make(map[string]map[string]bool)
+		order := make([]string, 0, len(runs))
+		for ip, hashes := range runs {
+			order = append(order, ip)
+			for _, hash := range hashes {
+				if holders[hash] == nil {
+					holders[hash] = make(map[string]bool)
+				}
+				holders[hash][ip] = true
 			}
-			// println("block:", lastblock.block.Transactions)
-			// println("query", transaction)
-			// println()
-			if lastblock.block.Transactions == transaction {
-				if curLength-lastblock.block.Index >= config.ConfirmsPerFileAppend {
-					return
+		}
+		// the longest runs first, a run that is part of one already added is skipped
+		sort.Slice(order, func(i, j int) bool { return len(runs[order[i]]) > len(runs[order[j]]) })
+		added := 0
+		for _, ip := range order {
+			last := runs[ip][len(runs[ip])-1]
+			hashes := make([]string, 0, len(runs[ip]))
+			for _, hash := range runs[ip] {
+				if lookupNode(hash) == nil {
+					hashes = append(hashes, hash)
 				}
 			}
-			lastblock = lastblock.parent
+			if len(hashes) > 0 {
+				added += attachBlocks(hashes, fetchBlocks(holders[last], hashes))
+			}
+			from[ip] = lookupNode(last)
+		}
+		println("synchronization added", added, "blocks from", len(runs), "peers, tip at", longestTip().block.Index)
+		if added == 0 {
+			break
 		}
-		// println("----------------")
 	}
+	return answered
+}
+
+// synchronization is the startup sync, the blocks flooded meanwhile are received after it
+func synchronization() {
+	println("******** Synchronization Receive block ***********")
+	if !syncWithPeers() {
+		println("synchronization: no peer answered, the sync manager keeps trying")
+	}
+	synQueueMutex.Lock()
+	hasSynchronize = true
+	parked := synTempQueue
+	synTempQueue = nil
+	synQueueMutex.Unlock()
+	for _, args := range parked {
+		receiveBlock(&args.Block, args.From)
+	}
+	println("******** End Synchronization Receive block *******")
+}
+
+/*** END Chain Sync ***/
+
+/*** Sync Manager ***/
+
+// After the startup sync a miner keeps catching up in the background. It syncs with
+// its peers every syncInterval, which finds nothing when its tip is as good as theirs,
+// and at once when a block arrives whose parent it doesn't have. The sender of such a
+// block is asked too, and becomes a peer if it was only dialing in. A miner that fell
+// behind through a partition or missed floods gets back on the best chain this way.
+
+const syncInterval = 10 * time.Second
+
+var syncMutex sync.Mutex                // one sync at a time
+var syncWanted = make(chan struct{}, 1) // wakes the sync manager
+var syncSources = make(map[string]bool) // senders of orphans, asked by the next sync
+var syncSourcesMutex sync.Mutex
+
+// requestSync wakes the sync manager, requests made while one is pending are merged.
+// from is the miner which sent a block with an unknown parent, "" if there is none.
+func requestSync(from string) {
+	if from != "" && validPeerAddr(from) {
+		syncSourcesMutex.Lock()
+		syncSources[from] = true
+		syncSourcesMutex.Unlock()
+	}
+	select {
+	case syncWanted <- struct{}{}:
+	default:
+	}
+}
+
+func syncManager() {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-syncWanted:
+		}
+		syncWithPeers()
+	}
+}
+
+/*** END Sync Manager ***/
+
+/*** Peer Manager ***/
+
+// The miner keeps one RPC client per peer instead of dialing for every message. Every
+// heartbeatInterval it pings each peer, which tells its tip height. A call that fails
+// or a ping that times out closes the client, and the peer is dialed again after a
+// backoff that doubles from minPeerBackoff up to maxPeerBackoff. Any other call that
+// times out is only given up, the calls next to it go on. Errors returned by the
+// handler of the peer don't count, the connection is fine. Type "peers" in the
+// terminal to see the state of every peer.
+
+const heartbeatInterval = 5 * time.Second
+const peerCallTimeout = 10 * time.Second
+const minPeerBackoff = 1 * time.Second
+const maxPeerBackoff = 1 * time.Minute
+
+// PeerState : what the miner knows about a peer
+type PeerState struct {
+	Addr      string
+	NodeID    string // from the handshake
+	Connected bool
+	LastSeen  time.Time     // last answer of the peer
+	Latency   time.Duration // of the last heartbeat
+	TipWork   *big.Int      // of the last heartbeat
+	Failures  int           // failed calls since the last answer
+	Refused   string        // why the last handshake failed
+}
+
+type peer struct {
+	state     PeerState
+	client    *rpc.Client
+	dialMutex sync.Mutex // one dial at a time, the other callers wait for it
+	backoff   time.Duration
+	retryAt   time.Time
+}
+
+var peerMutex sync.Mutex
+var peerTable = make(map[string]*peer)
+
+var errPeerBackoff = fmt.Errorf("peer is backing off")
+var errCallTimeout = fmt.Errorf("call timed out after %v", peerCallTimeout)
+
+// PingArgs : a heartbeat
+type PingArgs struct {
+	NetworkID string
+}
+
+// PingReply : the answer to a heartbeat
+type PingReply struct {
+	TipWork *big.Int
+}
+
+// Ping : heartbeat of a peer, answers with the work of the tip
+func (t *MinerHandle) Ping(args PingArgs, reply *PingReply) error {
+	if err := checkNetworkID(args.NetworkID); err != nil {
+		return err
+	}
+	reply.TipWork = longestTip().totalWork
+	return nil
+}
+
+// moreWork : a peer reported a tip with more work than the canonical one
+func moreWork(work *big.Int) bool {
+	return work != nil && work.Cmp(longestTip().totalWork) > 0
+}
+
+// addPeer makes addr a peer, it is dialed on the first call. False if it already was one.
+func addPeer(addr string) bool {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	if peerTable[addr] != nil {
+		return false
+	}
+	peerTable[addr] = &peer{state: PeerState{Addr: addr}}
+	return true
+}
+
+// removePeer closes the client of the peer and forgets its state
+func removePeer(addr string) {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	if p := peerTable[addr]; p != nil {
+		if p.client != nil {
+			p.client.Close()
+		}
+		delete(peerTable, addr)
+	}
+}
+
+// peerAddrs : the addresses of all the peers, sorted
+func peerAddrs() []string {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	addrs := make([]string, 0, len(peerTable))
+	for addr := range peerTable {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// peerStates : a copy of the state of every peer, sorted by address
+func peerStates() []PeerState {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	states := make([]PeerState, 0, len(peerTable))
+	for _, p := range peerTable {
+		states = append(states, p.state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Addr < states[j].Addr })
+	return states
+}
+
+// peerClient : the client of the peer, dialed if there is none and the backoff is over
+func peerClient(addr string) (*rpc.Client, error) {
+	peerMutex.Lock()
+	p := peerTable[addr]
+	peerMutex.Unlock()
+	if p == nil {
+		return nil, fmt.Errorf("%s is not a peer", addr)
+	}
+	p.dialMutex.Lock()
+	defer p.dialMutex.Unlock()
+	peerMutex.Lock()
+	client, retryAt := p.client, p.retryAt
+	peerMutex.Unlock()
+	if client != nil {
+		return client, nil
+	}
+	if time.Now().Before(retryAt) {
+		return nil, errPeerBackoff
+	}
+	client, err := dialPeer(addr)
+	if err != nil {
+		peerFailed(addr, nil, err)
+		return nil, err
+	}
+	if refused, err := handshake(addr, client); err != nil {
+		client.Close()
+		if refused {
+			peerRefused(addr, err)
+		} else {
+			peerFailed(addr, nil, err)
+		}
+		return nil, err
+	}
+	peerMutex.Lock()
+	p.client = client
+	p.state.Connected = true
+	peerMutex.Unlock()
+	go exchangePeers(addr)
+	return client, nil
+}
+
+// dialPeer is rpc.DialHTTP with peerCallTimeout on the dial and on the CONNECT answer
+func dialPeer(addr string) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, peerCallTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(peerCallTimeout))
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = fmt.Errorf("unexpected HTTP response: %s", resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
+
+// callPeer calls method on the peer with a timeout, over its long-lived client
+func callPeer(addr string, method string, args interface{}, reply interface{}) error {
+	client, err := peerClient(addr)
+	if err != nil {
+		return err
+	}
+	err = callWithTimeout(client, method, args, reply)
+	if err == errCallTimeout {
+		return err // the heartbeat tells whether the connection is dead
+	}
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		peerFailed(addr, client, err)
+		return err
+	}
+	peerAnswered(addr)
+	return err
+}
+
+// callWithTimeout gives up the call if it takes longer than peerCallTimeout, the
+// client stays open. The reply may still be written later, the caller must not read
+// it after an error.
+func callWithTimeout(client *rpc.Client, method string, args interface{}, reply interface{}) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(peerCallTimeout):
+		return errCallTimeout
+	}
+}
+
+func peerAnswered(addr string) {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	if p := peerTable[addr]; p != nil {
+		p.state.LastSeen = time.Now()
+		p.state.Failures = 0
+		p.backoff = 0
+	}
+}
+
+// peerFailed closes the client and schedules the next dial, client is nil if the dial failed
+func peerFailed(addr string, client *rpc.Client, err error) {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	p := peerTable[addr]
+	if p == nil {
+		return
+	}
+	if client != nil && p.client == client {
+		client.Close()
+		p.client = nil
+	}
+	if p.client != nil {
+		return // another call already redialed
+	}
+	if p.state.Connected {
+		printColorFont("red", "Lost peer "+addr+": "+err.Error())
+	}
+	p.state.Connected = false
+	p.state.Failures++
+	p.backoff *= 2
+	if p.backoff < minPeerBackoff {
+		p.backoff = minPeerBackoff
+	}
+	if p.backoff > maxPeerBackoff {
+		p.backoff = maxPeerBackoff
+	}
+	p.retryAt = time.Now().Add(p.backoff)
+}
+
+// dropPeerClient closes the client of a peer which stopped answering
+func dropPeerClient(addr string, err error) {
+	peerMutex.Lock()
+	var client *rpc.Client
+	if p := peerTable[addr]; p != nil {
+		client = p.client
+	}
+	peerMutex.Unlock()
+	if client != nil {
+		peerFailed(addr, client, err)
+	}
+}
+
+// reportPeerError prints the errors a peer returned, lost connections are reported by the peer manager
+func reportPeerError(addr string, method string, err error) {
+	if _, ok := err.(rpc.ServerError); ok {
+		println(method, "on", addr, "error:", err.Error())
+	}
+}
+
+// heartbeat pings every peer, a peer with a higher tip wakes the sync manager
+func heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		for _, addr := range peerAddrs() {
+			go pingPeer(addr)
+		}
+		<-ticker.C
+	}
+}
+
+func pingPeer(addr string) {
+	var reply PingReply
+	started := time.Now()
+	if err := callPeer(addr, "MinerHandle.Ping", PingArgs{networkID()}, &reply); err != nil {
+		if err == errCallTimeout {
+			dropPeerClient(addr, err)
+		}
+		reportPeerError(addr, "Ping", err)
+		return
+	}
+	peerMutex.Lock()
+	if p := peerTable[addr]; p != nil {
+		p.state.Latency = time.Since(started)
+		p.state.TipWork = reply.TipWork
+	}
+	peerMutex.Unlock()
+	if moreWork(reply.TipWork) {
+		requestSync("")
+	}
+}
+
+func printPeers() {
+	for _, state := range peerStates() {
+		lastSeen := "never"
+		if !state.LastSeen.IsZero() {
+			lastSeen = time.Since(state.LastSeen).Truncate(time.Millisecond).String() + " ago"
+		}
+		fmt.Printf("%s\tconnected:%v\tlast seen:%s\tlatency:%v\ttip work:%v\tfailures:%d\n",
+			state.Addr, state.Connected, lastSeen, state.Latency, state.TipWork, state.Failures)
+		if state.Refused != "" {
+			fmt.Printf("\trefused: %s\n", state.Refused)
+		}
+	}
+}
+
+/*** END Peer Manager ***/
+
+/*** Peer Discovery ***/
+
+// PeerMinersAddrs only seeds the peers. Miners swap the addresses they know with
+// ExchangePeers when they connect and every peerExchangeInterval, and the callee learns
+// the IncomingMinersAddr of the caller, so a miner also finds the miners that dial it.
+// Out of the known addresses the miner keeps TargetPeers outbound peers, drops a peer
+// which failed maxPeerFailures times in a row unless it is a seed, and keeps the known
+// addresses in peers.json of its data directory across restarts.
+
+const defaultTargetPeers = 8
+const maxKnownPeers = 1000
+const maxPeersPerExchange = 50
+const maxPeerFailures = 5
+const peerExchangeInterval = 1 * time.Minute
+
+// PeerExchangeArgs : the address of the calling miner and some of the addresses it knows
+type PeerExchangeArgs struct {
+	NetworkID string
+	Addr      string // IncomingMinersAddr of the caller
+	Peers     []string
+}
+
+var knownPeersMutex sync.Mutex
+var knownPeers = make(map[string]bool)
+var knownPeersChanged bool // not saved yet
+
+func targetPeers() int {
+	if config.TargetPeers > 0 {
+		return config.TargetPeers
+	}
+	return defaultTargetPeers
+}
+
+func isSeedPeer(addr string) bool {
+	for _, seed := range config.PeerMinersAddrs {
+		if seed == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// validPeerAddr : a host:port which is not this miner
+func validPeerAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || port == "" || port == "0" {
+		return false
+	}
+	return addr != config.IncomingMinersAddr
+}
+
+// learnPeers adds the valid addresses to the known peers
+func learnPeers(addrs []string) {
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+	for _, addr := range addrs {
+		if len(knownPeers) >= maxKnownPeers {
+			return
+		}
+		if validPeerAddr(addr) && !knownPeers[addr] {
+			knownPeers[addr] = true
+			knownPeersChanged = true
+		}
+	}
+}
+
+func forgetPeer(addr string) {
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+	if knownPeers[addr] {
+		delete(knownPeers, addr)
+		knownPeersChanged = true
+	}
+}
+
+// samplePeers : at most n of the known addresses in random order
+func samplePeers(n int) []string {
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+	addrs := make([]string, 0, len(knownPeers))
+	for addr := range knownPeers {
+		addrs = append(addrs, addr)
+	}
+	rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+	return addrs
+}
+
+// ExchangePeers : learn the caller and the addresses it sends, answer with some addresses this miner knows
+func (t *MinerHandle) ExchangePeers(args PeerExchangeArgs, reply *[]string) error {
+	if err := checkNetworkID(args.NetworkID); err != nil {
+		return err
+	}
+	if len(args.Peers) > maxPeersPerExchange {
+		args.Peers = args.Peers[:maxPeersPerExchange]
+	}
+	learnPeers(append(args.Peers, args.Addr))
+	*reply = samplePeers(maxPeersPerExchange)
+	return nil
+}
+
+func exchangePeers(addr string) {
+	var addrs []string
+	err := callPeer(addr, "MinerHandle.ExchangePeers", PeerExchangeArgs{networkID(), config.IncomingMinersAddr, samplePeers(maxPeersPerExchange)}, &addrs)
+	if err != nil {
+		reportPeerError(addr, "ExchangePeers", err)
+		return
+	}
+	if len(addrs) > maxPeersPerExchange {
+		addrs = addrs[:maxPeersPerExchange]
+	}
+	learnPeers(addrs)
+}
+
+// maintainPeers drops the peers which keep failing, then makes known addresses peers
+// until there are targetPeers
+func maintainPeers() {
+	count := 0
+	for _, state := range peerStates() {
+		if (state.Failures >= maxPeerFailures || state.Refused != "") && !isSeedPeer(state.Addr) {
+			removePeer(state.Addr)
+			forgetPeer(state.Addr)
+			println("Dropped peer", state.Addr, "after", state.Failures, "failures")
+			continue
+		}
+		count++
+	}
+	for _, addr := range samplePeers(maxKnownPeers) {
+		if count >= targetPeers() {
+			break
+		}
+		if addPeer(addr) {
+			println("New peer", addr)
+			count++
+		}
+	}
+	if err := saveKnownPeers(); err != nil {
+		printColorFont("red", "Fail to save peers: "+err.Error())
+	}
+}
+
+func peerDiscovery() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	lastExchange := time.Now()
+	for range ticker.C {
+		maintainPeers()
+		if time.Since(lastExchange) >= peerExchangeInterval {
+			for _, addr := range peerAddrs() {
+				go exchangePeers(addr)
+			}
+			lastExchange = time.Now()
+		}
+	}
+}
+
+func knownPeersFile() string {
+	return filepath.Join(dataDir(), "peers.json")
+}
+
+// loadKnownPeers reads the addresses saved by the last run, the seeds become peers
+func loadKnownPeers() {
+	data, err := ioutil.ReadFile(knownPeersFile())
+	if err == nil {
+		var addrs []string
+		if err := json.Unmarshal(data, &addrs); err != nil {
+			printColorFont("red", "Fail to read "+knownPeersFile()+": "+err.Error())
+		}
+		learnPeers(addrs)
+	} else if !os.IsNotExist(err) {
+		printColorFont("red", "Fail to read "+knownPeersFile()+": "+err.Error())
+	}
+	learnPeers(config.PeerMinersAddrs)
+	for _, addr := range config.PeerMinersAddrs {
+		addPeer(addr)
+	}
+}
+
+// saveKnownPeers writes the known addresses if they changed since the last save
+func saveKnownPeers() error {
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+	if !knownPeersChanged {
+		return nil
+	}
+	addrs := make([]string, 0, len(knownPeers))
+	for addr := range knownPeers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	data, err := json.MarshalIndent(addrs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dataDir(), 0755); err != nil {
+		return err
+	}
+	tmp := knownPeersFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, knownPeersFile()); err != nil {
+		return err
+	}
+	knownPeersChanged = false
+	return nil
+}
+
+/*** END Peer Discovery ***/
+
+/*** Handshake ***/
+
+// A miner swaps a Handshake with every peer it dials before any gossip. Either side
+// refuses the other, and logs why, when the protocol version, the genesis block or the
+// consensus parameters differ, or when the peer is the miner itself. A refused peer is
+// dialed again only after maxPeerBackoff, and dropped unless it is a seed. The gossip
+// RPCs carry the network ID, made of the same three, so a miner which skipped the
+// handshake is refused as well.
+
+const minerProtocolVersion = 2
+
+// Handshake : what two miners tell each other when they connect
+type Handshake struct {
+	NodeID          string // MinerID, the public key of the miner
+	ProtocolVersion int
+	GenesisHash     string
+	ConsensusHash   string // hash of consensusParams
+	TipWork         *big.Int
+	Addr            string // IncomingMinersAddr
+}
+
+func localHandshake() Handshake {
+	return Handshake{config.MinerID, minerProtocolVersion, root.hashvalue, consensusHash(), longestTip().totalWork, config.IncomingMinersAddr}
+}
+
+// consensusParams : the settings every block is checked against, miners which don't
+// share them reject each other's blocks
+func consensusParams() string {
+	return fmt.Sprintf("hash:%s coins:%d/%d/%d pow:%d/%d interval:%d retarget:%d records:%d",
+		blockHasher.Name(), config.MinedCoinsPerOpBlock, config.MinedCoinsPerNoOpBlock, config.NumCoinsPerFileCreate,
+		config.PowPerOpBlock, config.PowPerNoOpBlock, config.TargetBlockInterval, retargetBlocks(), minerChain.maxRecordNum)
+}
+
+func consensusHash() string {
+	return blockHasher.Sum([]byte(consensusParams()))
+}
+
+// networkID : protocol version, chain and consensus parameters in one hash
+func networkID() string {
+	return blockHasher.Sum([]byte(fmt.Sprintf("%d/%s/%s", minerProtocolVersion, chainID(), consensusHash())))
+}
+
+func checkNetworkID(id string) error {
+	if id != networkID() {
+		return fmt.Errorf("peer is on network %s, this miner is on network %s", id, networkID())
+	}
+	return nil
+}
+
+// checkHandshake : why this miner can't gossip with the one that sent h, nil if it can
+func checkHandshake(h *Handshake) error {
+	switch {
+	case h.NodeID == config.MinerID:
+		return fmt.Errorf("peer is this miner")
+	case h.ProtocolVersion != minerProtocolVersion:
+		return fmt.Errorf("peer speaks protocol version %d, this miner %d", h.ProtocolVersion, minerProtocolVersion)
+	case h.GenesisHash != root.hashvalue:
+		return fmt.Errorf("peer has genesis block %s, this miner %s", h.GenesisHash, root.hashvalue)
+	case h.ConsensusHash != consensusHash():
+		return fmt.Errorf("peer has consensus parameters %s, this miner %s (%s)", h.ConsensusHash, consensusHash(), consensusParams())
+	}
+	return nil
+}
+
+// Handshake : the handshake of a miner which dialed this one, answered with ours
+func (t *MinerHandle) Handshake(args Handshake, reply *Handshake) error {
+	if err := checkHandshake(&args); err != nil {
+		printColorFont("red", "Refused handshake of "+args.Addr+": "+err.Error())
+		return err
+	}
+	learnPeers([]string{args.Addr})
+	*reply = localHandshake()
+	return nil
+}
+
+// handshake swaps handshakes over a new client of the peer. refused is true if either
+// side's checkHandshake failed, a transport error is only a failure.
+func handshake(addr string, client *rpc.Client) (refused bool, err error) {
+	var remote Handshake
+	err = callWithTimeout(client, "MinerHandle.Handshake", localHandshake(), &remote)
+	if _, ok := err.(rpc.ServerError); ok {
+		return true, err // the peer's check refused us
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := checkHandshake(&remote); err != nil {
+		return true, err
+	}
+	peerMutex.Lock()
+	if p := peerTable[addr]; p != nil {
+		p.state.NodeID = remote.NodeID
+		p.state.TipWork = remote.TipWork
+		p.state.Refused = ""
+	}
+	peerMutex.Unlock()
+	if moreWork(remote.TipWork) {
+		requestSync("")
+	}
+	return false, nil
+}
+
+// peerRefused keeps the peer from being dialed for maxPeerBackoff
+func peerRefused(addr string, err error) {
+	printColorFont("red", "Refused peer "+addr+": "+err.Error())
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	if p := peerTable[addr]; p != nil {
+		p.state.Connected = false
+		p.state.Refused = err.Error()
+		p.state.Failures++
+		p.backoff = maxPeerBackoff
+		p.retryAt = time.Now().Add(maxPeerBackoff)
+	}
+}
+
+/*** END Handshake ***/
+
+func checkPeers()(connected bool){
+	// check if anyone is connected
+	for _, state := range peerStates() {
+		if state.Connected {
+			return true
+		}
+	}
+	return false
+}
+// thread to deal with incoming message from client
+func listenClient() {
+	ipport := strings.Split(config.IncomingClientsAddr, ":")
+	ip := ipport[0]
+	port, _ := strconv.Atoi(ipport[1])
+	listen, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(ip), Port: port})
+	if err != nil {
+		fmt.Println("Fail to monitor ", err.Error())
+		return
+	}
+	// fmt.Println("client port:", config.IncomingClientsAddr)
+
+	for {
+		conn, err := listen.AcceptTCP()
+		if err != nil {
+			fmt.Println(getTime())
+			println("Exception on client:", err.Error())
+			continue
+		}
+		go handleClientConn(conn)
+	}
+}
+
+// read the framed requests of one client and write back a reply for each of them.
+// rfslib keeps several requests in flight on one connection, so every request is
+// served in its own goroutine and the replies may go back in any order.
+func handleClientConn(conn net.Conn) {
+	defer conn.Close()
+	var writeMutex sync.Mutex
+	for {
+		request := &rfslib.Request{}
+		if err := rfslib.ReadFrame(conn, request); err != nil {
+			if err != io.EOF {
+				fmt.Println("error: ", err)
+			}
+			return
+		}
+		go func() {
+			var reply rfslib.Reply
+			if request.Version != rfslib.ProtocolVersion {
+				reply.Code = rfslib.CodeBadVersion
+				reply.Message = fmt.Sprintf("miner speaks version %d, not %d", rfslib.ProtocolVersion, request.Version)
+			} else {
+				reply = handleClientRequest(request)
+			}
+			reply.Version = rfslib.ProtocolVersion
+			reply.ID = request.ID
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			if err := rfslib.WriteFrame(conn, &reply); err != nil {
+				fmt.Println("error: ", err)
+			}
+		}()
+	}
+}
+
+func handleClientRequest(request *rfslib.Request) (reply rfslib.Reply) {
+	print(getTime() + ": ")
+	printColorFont("blue", "Operation: "+request.Op+" "+request.Name)
+	// if !checkPeers() {
+	// 	reply.Code = rfslib.CodeNoPeers
+	// 	return reply
+	// }
+	switch request.Op {
+	case "CreateFile", "AppendRec":
+		if err := checkOperationSize(request.Op, request.Name, request.Record); err != nil {
+			reply.Code = rfslib.CodeBadRequest
+			if err.Reason == RejectFileNameTooLong {
+				reply.Code = rfslib.CodeBadFilename
+			}
+			reply.Message = err.Error()
+			return reply
+		}
+	}
+	switch request.Op {
+	// Client CreateFile
+	case "CreateFile":
+		if checkfile(request.Name) == true {
+			reply.Code = rfslib.CodeFileExists
+			return reply
+		}
+		blockFileMutex.Lock()
+		blockFile[request.Name] = "" // create a new files
+		blockFileMutex.Unlock()
+		fmt.Println("-----------------")
+		fmt.Println(request.Op, request.Name)
+		fmt.Println("-----------------")
+		// codes about blockchain
+		operationMsg := generateOpMsg(request.Op, request.Name, nil)
+		reply.OpID = operationMsg.ID
+		reply.Interval = config.GenOpBlockTimeout
+		reply.MinerID = config.MinerID
+		pushRecordQueue(&operationMsg)
+		go broadcastOperations(operationMsg)
+	// Client ListFiles
+	case "ListFiles":
+		reply.Files = getFileList()
+	// Client TotalRecs
+	case "TotalRecs":
+		if checkfile(request.Name) == false {
+			reply.Code = rfslib.CodeFileDoesNotExist
+			return reply
+		}
+		reply.NumRecs = uint16(confirmedNumRecs(request.Name))
+	// Client ReadRec
+	case "ReadRec":
+		if checkfile(request.Name) == false {
+			reply.Code = rfslib.CodeFileDoesNotExist
+			return reply
+		}
+		entry := getConfirmedFile(request.Name)
+		if entry == nil || int(request.RecordNum) >= entry.numRecs {
+			reply.Code = rfslib.CodeRecordDoesNotExist
+		} else {
+			reply.Record = entry.record(int(request.RecordNum))
+		}
+	// Client ReadRecs: a range of records in one reply
+	case "ReadRecs":
+		if checkfile(request.Name) == false {
+			reply.Code = rfslib.CodeFileDoesNotExist
+			return reply
+		}
+		entry := getConfirmedFile(request.Name)
+		start := int(request.RecordNum)
+		if entry == nil || start >= entry.numRecs {
+			reply.Code = rfslib.CodeRecordDoesNotExist
+			return reply
+		}
+		end := start + int(request.Count)
+		if request.Count > rfslib.MaxRecordsPerReply {
+			end = start + rfslib.MaxRecordsPerReply
+		}
+		if end > entry.numRecs {
+			end = entry.numRecs
+		}
+		reply.Records = make([][]byte, 0, end-start)
+		for pos := start; pos < end; pos++ {
+			reply.Records = append(reply.Records, entry.record(pos))
+		}
+		reply.More = end < entry.numRecs
+	// Client AppendRec
+	case "AppendRec":
+		if checkfile(request.Name) == false {
+			reply.Code = rfslib.CodeFileDoesNotExist
+			return reply
+		}
+		if entry := longestTip().files.file(request.Name); entry != nil && entry.numRecs >= maxRecordsPerFile {
+			reply.Code = rfslib.CodeFileMaxLenReached
+			return reply
+		}
+		// codes about blockchain
+		operationMsg := generateOpMsg(request.Op, request.Name, request.Record)
+		pushRecordQueue(&operationMsg)
+		broadcastOperations(operationMsg)
+
+		node := queryRecord(operationMsg)
+		if node == nil {
+			reply.Code, _ = operationRejected(&operationMsg)
+			return reply
+		}
+		transaction := newTransaction(&operationMsg)
+		reply.NumRecs = uint16(recordPosition(node, &transaction))
+	case "queryFile":
+		switch queryFilePos(request.Name, request.MinerID, request.OpID) {
+		case "true":
+			reply.Confirmed = true
+		case "false":
+			reply.Code = rfslib.CodeFileExists
+		}
+	default:
+		reply.Code = rfslib.CodeBadRequest
+		reply.Message = "unknown operation " + request.Op
+	}
+	return reply
+}
+
+// check whether the CreateFile of fname requested through minerID is confirmed
+func queryFilePos(fname string, minerID string, opID string) string {
+	lastblock := longestTip()
+	curLength := lastblock.block.Index
+
+	entry := lastblock.files.file(fname)
+	if entry == nil {
+		return "wait"
+	}
+	if entry.createdBy != minerID+"/"+opID {
+		return "false"
+	}
+	if curLength-entry.createdIndex >= config.ConfirmsPerFileCreate {
+		return "true"
+	}
+	return "wait"
+}
+
+// wait until the operation has enough confirmations, returns the block which has it,
+// or nil if the operation was rejected
+func queryRecord(record OpMsg) *BlockNode {
+	key := opKey(&record)
+	ticker := time.NewTicker(time.Duration(config.GenOpBlockTimeout) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, ok := operationRejected(&record); ok {
+			return nil
+		}
+		tip := longestTip()
+		if node := blockWithOperation(tip, key); node != nil && tip.block.Index-node.block.Index >= config.ConfirmsPerFileAppend {
+			return node
+		}
+	}
+	return nil
+}
+
+// the block of the chain ending at tip which has the operation, nil if none has it
+func blockWithOperation(tip *BlockNode, key string) *BlockNode {
+	if !tip.files.hasOperation(key) {
+		return nil
+	}
+	node := tip
+	for node.parent != nil && node.parent.files.hasOperation(key) {
+		node = node.parent
+	}
+	return node
+}
+
+// position of the appended record in its file, the records before the block plus
+// the ones before it in the block
+func recordPosition(node *BlockNode, tx *Transaction) int {
+	pos := 0
+	if entry := node.parent.files.file(tx.FileName); entry != nil {
+		pos = entry.numRecs
+	}
+	for i := range node.block.Transactions {
+		other := &node.block.Transactions[i]
+		if other.equal(tx) {
+			break
+		}
+		if other.Op == "AppendRec" && other.FileName == tx.FileName {
+			pos++
+		}
+	}
+	return pos
 }
 
 /*** Blockchain ***/
@@ -769,479 +1796,1804 @@ type BlockNode struct {
 	hashvalue     string
 	blockChildren []*BlockNode
 	parent        *BlockNode
+	files         *fileState // the files of the chain ending at this block
+	totalWork     *big.Int   // expected number of hashes to mine the chain ending at this block
+	target        *big.Int   // target of a no-op block at the height of this block
+}
+
+var root BlockNode
+
+var longestMutex sync.Mutex // longestMutex to protect canonicalTip
+var tipMoveMutex sync.Mutex // held across a tip move and its reorg event, so events keep the order of the moves
+var canonicalTip *BlockNode // the tip of the chain with the most work
+var tailNodes []*BlockNode
+
+var treeMutex sync.RWMutex           // protects blockIndex and the blockChildren of every node
+var blockIndex map[string]*BlockNode // hash -> node, every node of the tree
+
+// the node of the block with the given hash, nil if it is not in the tree
+func lookupNode(hash string) *BlockNode {
+	treeMutex.RLock()
+	defer treeMutex.RUnlock()
+	return blockIndex[hash]
+}
+
+func (node *BlockNode) children() []*BlockNode {
+	treeMutex.RLock()
+	defer treeMutex.RUnlock()
+	return append([]*BlockNode(nil), node.blockChildren...)
+}
+
+// addChild attaches the block to the tree and persists it into the block store.
+// Returns the new node, nil if the block is already there or its parent is unknown.
+func (root *BlockNode) addChild(node Block) *BlockNode {
+	child := root.attachChild(node)
+	if child == nil || blockStore == nil {
+		return child
+	}
+	if err := blockStore.append(child.hashvalue, &child.block); err != nil {
+		printColorFont("red", "Fail to persist block "+child.hashvalue+": "+err.Error())
+	}
+	return child
+}
+
+// attachChild only updates the in-memory tree, it is also used to replay the block store
+func (root *BlockNode) attachChild(node Block) *BlockNode {
+	// println("-------- addChild ---------")
+	hash := minerChain.hashBlock(&node)
+	treeMutex.Lock()
+	parent := blockIndex[node.PrevHash]
+	if parent == nil || blockIndex[hash] != nil {
+		treeMutex.Unlock()
+		if parent == nil {
+			printColorFont("red", "No such node has prevHash: "+node.PrevHash)
+		}
+		return nil
+	} else {
+		// println("Add into tree successfully")
+		work := new(big.Int).Add(parent.totalWork, blockWork(blockTarget(parent, &node)))
+		child := &BlockNode{node, hash, nil, parent, parent.files.apply(&node), work, nextTarget(parent)}
+		parent.blockChildren = append(parent.blockChildren, child)
+		blockIndex[hash] = child
+		treeMutex.Unlock()
+
+		// switch to the new chain if it has more work
+		tipMoveMutex.Lock()
+		longestMutex.Lock()
+		oldTip := canonicalTip
+		isBetter := betterTip(child, oldTip)
+		if isBetter {
+			canonicalTip = child
+		}
+		longestMutex.Unlock()
+		if isBetter {
+			publishReorg(oldTip, child)
+		}
+		tipMoveMutex.Unlock()
+		// println("-------- End addChild ---------\n")
+		return child
+	}
+}
+
+// betterTip : the chain with the most work wins, a tie goes to the lowest hash so that
+// every miner picks the same tip out of the same tree
+func betterTip(node *BlockNode, tip *BlockNode) bool {
+	cmp := node.totalWork.Cmp(tip.totalWork)
+	return cmp > 0 || (cmp == 0 && node.hashvalue < tip.hashvalue)
+}
+
+// expected number of hashes to find a block of the target: 2^256 / (target+1)
+func blockWork(target *big.Int) *big.Int {
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), new(big.Int).Add(target, big.NewInt(1)))
+}
+
+func commonAncestor(a *BlockNode, b *BlockNode) *BlockNode {
+	for a != b {
+		if a.block.Index >= b.block.Index {
+			a = a.parent
+		} else {
+			b = b.parent
+		}
+	}
+	return a
+}
+
+// ReorgEvent : the canonical tip moved from OldTip to NewTip. When NewTip just extends
+// OldTip, CommonAncestor is OldTip, otherwise the blocks between CommonAncestor and
+// OldTip left the canonical chain.
+type ReorgEvent struct {
+	OldTip         *BlockNode
+	NewTip         *BlockNode
+	CommonAncestor *BlockNode
+}
+
+func (event *ReorgEvent) isReorg() bool {
+	return event.CommonAncestor != event.OldTip
+}
+
+var reorgMutex sync.Mutex
+
+type reorgHandler func(event ReorgEvent)
+
+var reorgSubscribers []reorgHandler
+var reorgEvents = make(chan ReorgEvent, 64)
+
+// subscribeReorg registers handler for every move of the canonical tip. Handlers run one
+// after another on a single goroutine, in the order the tip moved.
+func subscribeReorg(handler reorgHandler) {
+	reorgMutex.Lock()
+	defer reorgMutex.Unlock()
+	reorgSubscribers = append(reorgSubscribers, handler)
+}
+
+func publishReorg(oldTip *BlockNode, newTip *BlockNode) {
+	event := ReorgEvent{oldTip, newTip, commonAncestor(oldTip, newTip)}
+	if event.isReorg() {
+		printColorFont("purple", fmt.Sprintf("Reorg: tip %d %s -> %d %s, fork at %d",
+			oldTip.block.Index, oldTip.hashvalue, newTip.block.Index, newTip.hashvalue, event.CommonAncestor.block.Index))
+	}
+	reorgEvents <- event
+}
+
+// deliver the reorg events to the subscribers
+func dispatchReorgs() {
+	for event := range reorgEvents {
+		reorgMutex.Lock()
+		subscribers := append([]reorgHandler(nil), reorgSubscribers...)
+		reorgMutex.Unlock()
+		for _, handler := range subscribers {
+			handler(event)
+		}
+	}
+}
+
+func printTreeNode(node BlockNode, suffix string) {
+	if len(node.block.Transactions) == 0 {
+			fmt.Println(suffix+"---------")
+			println(suffix+"Index:", node.block.Index)
+			println(suffix+"Miner:", node.block.Miner)
+			println(suffix+"PrevHash:", node.block.PrevHash)
+			println(suffix+"Transaction: No-op")
+			fmt.Println(suffix+"---------")
+	} else {
+		fmt.Println(suffix+"==================================== TRANSACTION BLOCK ====================================")
+		println(suffix+"Index:", node.block.Index)
+		println(suffix+"Hashvalue:", node.hashvalue)
+		println(suffix+"PrevHash:", node.block.PrevHash)
+		println(suffix+"Timestamp:", node.block.Timestamp)
+		println(suffix+"Miner:", node.block.Miner)
+		println(suffix+"Nonce:", node.block.Nonce)
+		println(suffix+"_____________TRANSACTIONS_____________")
+		for _, tx := range node.block.Transactions {
+			println(suffix+"#{")
+			println(suffix+tx.FileName)
+			println(suffix+string(tx.Content))
+			println(suffix+tx.Op)
+			println(suffix+"}#")
+		}
+		println(suffix+"END TRANSACTIONS")
+		fmt.Println(suffix+"============================================================================================")
+	}
+	println(suffix + "Children:")
+	for i := 0; i < len(node.blockChildren); i++ {
+		child := node.blockChildren[i]
+		createIndent := ""
+		if(i > 0){
+			createIndent = "\t"
+		}
+		println(suffix + "\t" + strconv.Itoa(i))
+		printTreeNode(*child, suffix + createIndent)
+		println()
+	}
+}
+
+func (root *BlockNode) printTree() {
+	println("---------------------- Tree ------------------------------")
+	printTreeNode(*root, "")
+	println("---------------------- End Tree --------------------------")
+}
+
+// Block is a single structure in the chain
+type Block struct {
+	PrevHash     string
+	Index        int   // the position in blockchain
+	Timestamp    int64 // nanoseconds elapsed since January 1, 1970 UTC.
+	Nonce        uint32
+	ExtraNonce   uint64 // moves on when no Nonce solves the block
+	Miner        string // MinerID of the miner that mined the block and gets its coins
+	Transactions []Transaction
+	Signature    []byte // signature of the block hash by the key of Miner
+}
+
+// Transaction is a client operation recorded in a block
+type Transaction struct {
+	Op        string // CreateFile or AppendRec
+	FileName  string
+	Content   []byte
+	MinerID   string // the miner which received the operation from its client and pays for it
+	ID        string
+	Signature []byte // signature of the operation by MinerID
+}
+
+func newTransaction(opmsg *OpMsg) Transaction {
+	return Transaction{opmsg.Op, opmsg.Name, opmsg.Content, opmsg.MinerID, opmsg.ID, opmsg.Signature}
+}
+
+func (tx *Transaction) opMsg() *OpMsg {
+	return &OpMsg{tx.MinerID, tx.ID, tx.Op, tx.FileName, tx.Content, tx.Signature}
+}
+
+// the id of an operation stands for all of it, its signature covers the id
+func (tx *Transaction) equal(other *Transaction) bool {
+	return tx.MinerID == other.MinerID && tx.ID == other.ID
+}
+
+func (block *Block) hasTransaction(tx *Transaction) bool {
+	for i := range block.Transactions {
+		if block.Transactions[i].equal(tx) {
+			return true
+		}
+	}
+	return false
+}
+
+// BlockChain is the central datastructure
+type BlockChain struct {
+	chainLock    *sync.Mutex
+	chain        []*Block
+	maxRecordNum int
+	difficulty   int
+}
+
+func (bc *BlockChain) init() {
+	// create genesis block
+	block := &Block{}
+	block.PrevHash = config.GenesisBlockHash
+	block.Nonce = 0
+	bc.chain = append(bc.chain, block)
+	fmt.Println("Genisis block created.")
+
+	// tree
+	root = BlockNode{*block, minerChain.hashBlock(block), nil, nil, &fileState{}, big.NewInt(0), digitsTarget(config.PowPerNoOpBlock)} // initial tree
+	blockIndex = map[string]*BlockNode{root.hashvalue: &root}
+
+	longestMutex.Lock()
+	canonicalTip = &root
+	longestMutex.Unlock()
+
+	//bc.manageChain()
+}
+
+func startBlockGeneration() {
+	ticker := time.NewTicker(time.Duration(config.GenOpBlockTimeout) * time.Second)
+	for range ticker.C {
+		// a block given up for a new tip is mined again on it right away
+		for createTransactionBlock() == false {
+		}
+	}
+}
+
+func printLedge() {
+	lastblock := longestTip()
+	ledge := getLedge(lastblock)
+	println("--------- Ledge -------------")
+	for k, v := range ledge {
+		fmt.Printf("| %s\t%d\n", k, v)
+	}
+	println("--------- End Ledge ---------")
+}
+
+func getLedge(blocknode *BlockNode) map[string]int {
+	ledge := make(map[string]int)
+	for {
+		if blocknode.parent == nil {
+			return ledge
+		}
+		blockMinerID := blocknode.block.Miner
+		if _, ok := ledge[blockMinerID]; !ok {
+			ledge[blockMinerID] = 0
+		}
+
+		if len(blocknode.block.Transactions) == 0 {
+			ledge[blockMinerID] += config.MinedCoinsPerNoOpBlock
+		} else {
+			ledge[blockMinerID] += config.MinedCoinsPerOpBlock
+		}
+
+		for _, tx := range blocknode.block.Transactions {
+			minerID := tx.MinerID
+			if _, ok := ledge[minerID]; !ok {
+				ledge[minerID] = 0
+			}
+			if tx.Op == "CreateFile" {
+				ledge[minerID] -= config.NumCoinsPerFileCreate
+			} else if tx.Op == "AppendRec" {
+				ledge[minerID]-- //just one coin
+			}
+		}
+		blocknode = blocknode.parent
+	}
+}
+
+// coins an operation costs the miner that pays for it
+func operationCost(op string) int {
+	if op == "CreateFile" {
+		return config.NumCoinsPerFileCreate
+	}
+	return 1
+}
+
+func hasCoins(ledge map[string]int, minerID string, op string) bool {
+	balance, ok := ledge[minerID]
+	return ok && balance >= operationCost(op)
+}
+
+func chargeTransaction(ledge map[string]int, tx *Transaction) {
+	ledge[tx.MinerID] -= operationCost(tx.Op)
+}
+
+func checkBalance(operationMsg OpMsg) bool {
+	lastblock := longestTip()
+	ledge := getLedge(lastblock)
+
+	minerID := operationMsg.MinerID
+
+	if _, ok := ledge[minerID]; !ok {
+		// println("@@@@@@@@@@@@")
+		// fmt.Printf("%v\n", operationMsg)
+		// println("Now", minerID, "balance is", 0)
+		// println("@@@@@@@@@@@@")
+
+		return false
+	}
+
+	// println("@@@@@@@@@@@@")
+	// fmt.Printf("%v\n", operationMsg)
+	// println("Now", minerID, "balance is", ledge[minerID])
+	// println("@@@@@@@@@@@@")
+
+	if operationMsg.Op == "CreateFile" {
+		if ledge[minerID] < config.NumCoinsPerFileCreate {
+			return false
+		}
+		return true
+	}
+	if operationMsg.Op == "AppendRec" {
+		if ledge[minerID] < 1 {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// check the hash of the block is not above the target
+func (bc *BlockChain) checkProofOfWork(block *Block, target *big.Int) bool {
+	blockHash := bc.hashBlock(block)
+	hasCorrectHash := meetsTarget(blockHash, target)
+	if !hasCorrectHash {
+		fmt.Println("BlockHash:\t", blockHash)
+		fmt.Println("BlockNonce:\t", block.Nonce)
+		fmt.Println("Hint: Incorrect hash")
+		return false
+	}
+	return true
+}
+
+func (bc *BlockChain) verifyBlock(block *Block) (isValidBlock bool) {
+	if err := bc.validateBlock(lookupNode(block.PrevHash), block); err != nil {
+		fmt.Println("Hint:", err)
+		return false
+	}
+	return true
+}
+
+// a CreateFile is in the chain if any miner created the file, an AppendRec only if the same operation is there
+func checkRecordInChain(record *OpMsg, node *BlockNode) bool {
+	if record.Op == "CreateFile" {
+		return node.files.file(record.Name) != nil
+	}
+	return node.files.hasOperation(opKey(record))
+}
+
+// when timeout, you just use API createBlock
+// the function will read records from the queue
+// and generate a new block
+// createTransactionBlock mines a block of the queued operations on the canonical tip,
+// false if the tip moved meanwhile and the operations went back into the queue
+func createTransactionBlock() bool {
+	// set prev hash
+	block := &Block{}
+
+	lastblock := longestTip()
+	block.Index = lastblock.block.Index + 1
+
+	block.PrevHash = lastblock.hashvalue
+
+	// block.Transactions = bc.txBuffer
+	block.Timestamp = makeTimestamp()
+	if block.Timestamp <= lastblock.block.Timestamp {
+		block.Timestamp = lastblock.block.Timestamp + 1 // the clock of the parent's miner is ahead
+	}
+	block.Miner = config.MinerID
+
+	var transactionNum int
+	ledge := getLedge(lastblock)
+	state := lastblock.files
+
+	for {
+		// operations whose miner can't pay yet stay queued until it earns coins
+		record := popRecordQueueIf(func(record *OpMsg) bool {
+			return hasCoins(ledge, record.MinerID, record.Op)
+		})
+		if record == nil {
+			break // nothing queued can pay, maybe a no-op block
+		}
+		transaction := newTransaction(record)
+		if checkRecordInChain(record, lastblock) == true || block.hasTransaction(&transaction) {
+			printColorFont("red", config.MinerID+" already in chain: "+record.Op+" "+record.Name+" "+record.MinerID+" "+record.ID)
+			continue
+		}
+		if err := checkTransaction(state, ledge, &transaction); err != nil {
+			switch err.Reason {
+			case RejectFileExists:
+				// created by another operation of this block
+				printColorFont("red", config.MinerID+" already in chain: "+record.Op+" "+record.Name+" "+record.MinerID+" "+record.ID)
+			case RejectFileDoesNotExist:
+				// the file went away with a reorg
+				rejectOperation(record, rfslib.CodeFileDoesNotExist)
+			case RejectFileFull:
+				rejectOperation(record, rfslib.CodeFileMaxLenReached)
+			default:
+				printColorFont("red", "Drop operation "+opKey(record)+": "+err.Error())
+			}
+			continue
+		}
+		block.Transactions = append(block.Transactions, transaction)
+		state = state.applyTransaction(&transaction, block.Index)
+		chargeTransaction(ledge, &transaction)
+		transactionNum++
+		if transactionNum == minerChain.maxRecordNum {
+			break
+		}
+	}
+
+	// it's not right, just for convenience
+	if transactionNum == 0 {
+		if disableNoOp == true {
+			return true
+		}
+	}
+
+	// mine the block to find solution
+	ctx := startMining(lastblock)
+	started := time.Now()
+	_, found := minerChain.mineBlock(ctx, block, blockTarget(lastblock, block))
+	stopMining()
+	if !found {
+		records := make([]*OpMsg, 0, len(block.Transactions))
+		for _, tx := range block.Transactions {
+			records = append(records, tx.opMsg())
+		}
+		requeueRecords(records)
+		printColorFont("purple", "Tip moved, mining block "+strconv.Itoa(block.Index)+" again on the new tip")
+		return false
+	}
+	signBlock(block)
+	fmt.Printf("Mined block %d in %v, %.0f hashes/s\n", block.Index, time.Since(started), hashRate())
+
+	// println("***************** Found Solution for block: ")
+	// // fmt.Printf("* Block Info\n")
+	// println("*Index:", block.Index)
+	// // println("*Miner:", block.Miner)
+	// // println("*Transaction:", block.Transactions)
+	// println("*Nonce:", block.Nonce)
+	// println("***************** end solution.")
+
+	// add to own chain first before broadcasting.
+	if node := root.addChild(*block); node != nil {
+		broadcastBlocks(block)
+		adoptOrphans(node.hashvalue)
+		if tip := longestTip(); commonAncestor(node, tip) != node {
+			// a peer's block won while mining, this one is off the canonical chain
+			requeueAbandoned(node, node.parent, tip)
+		}
+	}
+	return true
+}
+
+// requeueAbandoned puts the operations of the blocks from node back to stop (excluded),
+// which are no longer on the canonical chain, back into recordQueue unless tip has them
+func requeueAbandoned(node *BlockNode, stop *BlockNode, tip *BlockNode) {
+	records := make([]*OpMsg, 0)
+	for ; node != nil && node != stop; node = node.parent {
+		blockRecords := make([]*OpMsg, 0, len(node.block.Transactions))
+		for _, tx := range node.block.Transactions {
+			record := tx.opMsg()
+			if checkRecordInChain(record, tip) == false {
+				blockRecords = append(blockRecords, record)
+			}
+		}
+		records = append(blockRecords, records...) // older blocks first
+	}
+	if len(records) == 0 {
+		return
+	}
+	printColorFont("purple", "Requeue "+strconv.Itoa(len(records))+" operations left behind by a reorg")
+	requeueRecords(records)
+}
+
+// after a reorg the operations of the abandoned blocks go back into the queue
+func requeueOnReorg(event ReorgEvent) {
+	if event.isReorg() {
+		requeueAbandoned(event.OldTip, event.CommonAncestor, event.NewTip)
+	}
+}
+
+func (bc *BlockChain) hashBlock(block *Block) (str string) {
+	header := block.header()
+	return hashHeader(&header)
+}
+
+// BlockHeader : a block without its transactions, TxHash stands for them. The hash of a
+// block is the hash of its header, so the proof of work, the signature and the linkage
+// of a chain can be checked before any transaction is downloaded.
+type BlockHeader struct {
+	PrevHash   string
+	Index      int
+	Timestamp  int64
+	Nonce      uint32
+	ExtraNonce uint64
+	Miner      string
+	TxHash     string
+	Signature  []byte
+}
+
+func (block *Block) header() BlockHeader {
+	return BlockHeader{block.PrevHash, block.Index, block.Timestamp, block.Nonce, block.ExtraNonce, block.Miner, transactionsHash(block.Transactions), block.Signature}
+}
+
+func transactionsHash(transactions []Transaction) string {
+	return blockHasher.Sum(encodeTransactions(transactions))
+}
+
+func hashHeader(header *BlockHeader) string {
+	return blockHasher.Sum(getHeaderBytes(header))
+}
+
+// getHeaderBytes is the canonical binary form of the header that goes into the block
+// hash. Strings are prefixed by their length and numbers are fixed width big endian,
+// so no two headers encode to the same bytes.
+func getHeaderBytes(header *BlockHeader) []byte {
+	var buf bytes.Buffer
+	writeLengthPrefixed(&buf, []byte(header.PrevHash))
+	var numbers [28]byte
+	binary.BigEndian.PutUint64(numbers[0:8], uint64(header.Index))
+	binary.BigEndian.PutUint64(numbers[8:16], uint64(header.Timestamp))
+	binary.BigEndian.PutUint32(numbers[16:20], header.Nonce)
+	binary.BigEndian.PutUint64(numbers[20:28], header.ExtraNonce)
+	buf.Write(numbers[:])
+	// the miner is in the hash, so its coins can't be given to another miner
+	writeLengthPrefixed(&buf, []byte(header.Miner))
+	writeLengthPrefixed(&buf, []byte(header.TxHash))
+	return buf.Bytes()
+}
+
+// encodeTransactions is the canonical binary form of the transactions that goes into the
+// block hash. Every field is prefixed by its length, so no content can be mistaken for
+// the boundary of a field or of a transaction. A no-op block encodes to nothing.
+func encodeTransactions(transactions []Transaction) []byte {
+	if len(transactions) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	writeUvarint(&buf, uint64(len(transactions)))
+	for _, tx := range transactions {
+		writeLengthPrefixed(&buf, []byte(tx.Op))
+		writeLengthPrefixed(&buf, []byte(tx.FileName))
+		writeLengthPrefixed(&buf, tx.Content)
+		writeLengthPrefixed(&buf, []byte(tx.MinerID))
+		writeLengthPrefixed(&buf, []byte(tx.ID))
+		writeLengthPrefixed(&buf, tx.Signature)
+	}
+	return buf.Bytes()
+}
+
+func writeUvarint(buf *bytes.Buffer, x uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	buf.Write(tmp[:n])
+}
+
+func writeLengthPrefixed(buf *bytes.Buffer, data []byte) {
+	writeUvarint(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+func Initial() {
+	hasher, err := selectHasher(config.HashFunction)
+	if err != nil {
+		log.Fatal(err)
+	}
+	blockHasher = hasher
+	loadIdentity()
+	blockFile = make(map[string]string)
+	recordQueue = make([]*OpMsg, 0)
+	recordTrash = make([]*OpMsg, 0)
+	minerChain = &BlockChain{
+		chainLock:    &sync.Mutex{},
+		chain:        make([]*Block, 0),
+		maxRecordNum: 2, // the maximum records in one block
+		difficulty:   5,
+	}
+	minerChain.init()
+	fmt.Println("Chain:", chainID())
+	fmt.Println("Network:", networkID(), consensusParams())
+	subscribeReorg(requeueOnReorg)
+	subscribeReorg(cancelStaleMining)
+	go dispatchReorgs()
+	loadBlockStore()
+	loadKnownPeers()
+
+	rand.Seed(time.Now().Unix())
 }
 
-var root BlockNode
+/*** END Blockchain ***/
 
-var longestMutex sync.Mutex        // longestMutex to protect both maxLength and longestChainNodes
-var maxLength int                  // length of longest chain
-var longestChainNodes []*BlockNode // to record the tail node address of longest chain
-var tailNodes []*BlockNode
+/*** Block Validation ***/
+
+// RejectReason tells which consensus rule a block breaks
+type RejectReason int
+
+const (
+	RejectUnknownParent RejectReason = iota + 1
+	RejectBadIndex
+	RejectTimestampNotAfterParent
+	RejectTimestampInFuture
+	RejectTooManyTransactions
+	RejectBadProofOfWork
+	RejectBadBlockSignature
+	RejectUnknownOperation
+	RejectBadOperationSignature
+	RejectDuplicateTransaction
+	RejectReplayedOperation
+	RejectFileExists
+	RejectFileDoesNotExist
+	RejectFileFull
+	RejectInsufficientCoins
+	RejectBadRecordSize
+	RejectFileNameTooLong
+)
 
-func (root *BlockNode) addChild(node Block) {
-	// println("-------- addChild ---------")
-	parent := root.findNode(node.PrevHash)
+func (r RejectReason) String() string {
+	switch r {
+	case RejectUnknownParent:
+		return "UnknownParent"
+	case RejectBadIndex:
+		return "BadIndex"
+	case RejectTimestampNotAfterParent:
+		return "TimestampNotAfterParent"
+	case RejectTimestampInFuture:
+		return "TimestampInFuture"
+	case RejectTooManyTransactions:
+		return "TooManyTransactions"
+	case RejectBadProofOfWork:
+		return "BadProofOfWork"
+	case RejectBadBlockSignature:
+		return "BadBlockSignature"
+	case RejectUnknownOperation:
+		return "UnknownOperation"
+	case RejectBadOperationSignature:
+		return "BadOperationSignature"
+	case RejectDuplicateTransaction:
+		return "DuplicateTransaction"
+	case RejectReplayedOperation:
+		return "ReplayedOperation"
+	case RejectFileExists:
+		return "FileExists"
+	case RejectFileDoesNotExist:
+		return "FileDoesNotExist"
+	case RejectFileFull:
+		return "FileFull"
+	case RejectInsufficientCoins:
+		return "InsufficientCoins"
+	case RejectBadRecordSize:
+		return "BadRecordSize"
+	case RejectFileNameTooLong:
+		return "FileNameTooLong"
+	}
+	return fmt.Sprintf("RejectReason(%d)", int(r))
+}
+
+// BlockError is the rule a block breaks and the detail of how
+type BlockError struct {
+	Reason RejectReason
+	Detail string
+}
+
+func (e *BlockError) Error() string {
+	return "block rejected, " + e.Reason.String() + ": " + e.Detail
+}
+
+func rejectBlock(reason RejectReason, format string, args ...interface{}) *BlockError {
+	return &BlockError{reason, fmt.Sprintf(format, args...)}
+}
+
+// how far the timestamp of a block may be ahead of the clock of the miner checking it
+const maxFutureBlockTime = 2 * time.Minute
+
+const recordSize = 512    // bytes of the content of an AppendRec
+const maxFileNameLen = 64 // bytes of a file name
+
+// validateBlock checks every consensus rule of block as a child of parent
+func (bc *BlockChain) validateBlock(parent *BlockNode, block *Block) error {
 	if parent == nil {
-		printColorFont("red", "No such node has prevHash: "+node.PrevHash)
-	} else {
-		// println("Add into tree successfully")
-		child := &BlockNode{node, minerChain.hashBlock(&node), nil, parent}
-		parent.blockChildren = append(parent.blockChildren, child)
+		return rejectBlock(RejectUnknownParent, "no block %s", block.PrevHash)
+	}
+	if block.Index != parent.block.Index+1 {
+		return rejectBlock(RejectBadIndex, "index %d on a parent of index %d", block.Index, parent.block.Index)
+	}
+	if block.Timestamp <= parent.block.Timestamp {
+		return rejectBlock(RejectTimestampNotAfterParent, "timestamp %d, parent %d", block.Timestamp, parent.block.Timestamp)
+	}
+	if limit := makeTimestamp() + int64(maxFutureBlockTime); block.Timestamp > limit {
+		return rejectBlock(RejectTimestampInFuture, "timestamp %d, latest allowed %d", block.Timestamp, limit)
+	}
+	if len(block.Transactions) > bc.maxRecordNum {
+		return rejectBlock(RejectTooManyTransactions, "%d transactions, at most %d", len(block.Transactions), bc.maxRecordNum)
+	}
+	if !bc.checkProofOfWork(block, blockTarget(parent, block)) {
+		return rejectBlock(RejectBadProofOfWork, "hash %s above the target", bc.hashBlock(block))
+	}
+	if !verifyBlockSignature(block) {
+		return rejectBlock(RejectBadBlockSignature, "block %d by %s", block.Index, block.Miner)
+	}
+	ledge := getLedge(parent)
+	state := parent.files
+	seen := make(map[string]bool)
+	for i := range block.Transactions {
+		tx := &block.Transactions[i]
+		record := tx.opMsg()
+		if verifyOperation(record) == false {
+			return rejectBlock(RejectBadOperationSignature, "%s %s %s", tx.Op, tx.FileName, opKey(record))
+		}
+		if seen[opKey(record)] {
+			return rejectBlock(RejectDuplicateTransaction, "%s %s %s", tx.Op, tx.FileName, opKey(record))
+		}
+		seen[opKey(record)] = true
+		if state.hasOperation(opKey(record)) {
+			return rejectBlock(RejectReplayedOperation, "%s %s %s is already in the chain", tx.Op, tx.FileName, opKey(record))
+		}
+		if err := checkTransaction(state, ledge, tx); err != nil {
+			return err
+		}
+		state = state.applyTransaction(tx, block.Index)
+		chargeTransaction(ledge, tx)
+	}
+	return nil
+}
 
-		// find a new longest chain
-		if node.Index > maxLength {
-			longestMutex.Lock()
-			maxLength = node.Index
-			longestChainNodes = make([]*BlockNode, 0)
-			longestChainNodes = append(longestChainNodes, child)
-			longestMutex.Unlock()
-		} else if node.Index == maxLength {
-			// more than one longest chain
-			longestMutex.Lock()
-			longestChainNodes = append(longestChainNodes, child)
-			longestMutex.Unlock()
+// checkTransaction checks tx can follow the files and coin balances of the chain so far
+func checkTransaction(state *fileState, ledge map[string]int, tx *Transaction) *BlockError {
+	if err := checkOperationSize(tx.Op, tx.FileName, tx.Content); err != nil {
+		return err
+	}
+	switch tx.Op {
+	case "CreateFile":
+		if state.file(tx.FileName) != nil {
+			return rejectBlock(RejectFileExists, "CreateFile %s", tx.FileName)
 		}
+	case "AppendRec":
+		entry := state.file(tx.FileName)
+		if entry == nil {
+			return rejectBlock(RejectFileDoesNotExist, "AppendRec %s", tx.FileName)
+		}
+		if entry.numRecs >= maxRecordsPerFile {
+			return rejectBlock(RejectFileFull, "AppendRec %s", tx.FileName)
+		}
+	default:
+		return rejectBlock(RejectUnknownOperation, "%s %s", tx.Op, tx.FileName)
+	}
+	if !hasCoins(ledge, tx.MinerID, tx.Op) {
+		return rejectBlock(RejectInsufficientCoins, "%s %s by %s", tx.Op, tx.FileName, tx.MinerID)
+	}
+	return nil
+}
+
+// checkOperationSize : an AppendRec carries exactly one record, a CreateFile none, and
+// the file name is at most maxFileNameLen bytes
+func checkOperationSize(op string, fileName string, content []byte) *BlockError {
+	if len(fileName) > maxFileNameLen {
+		return rejectBlock(RejectFileNameTooLong, "%s of a name of %d bytes", op, len(fileName))
+	}
+	if op == "AppendRec" && len(content) != recordSize || op == "CreateFile" && len(content) != 0 {
+		return rejectBlock(RejectBadRecordSize, "%s %s with %d bytes", op, fileName, len(content))
+	}
+	return nil
+}
+
+/*** END Block Validation ***/
+
+/*** Difficulty ***/
+
+// The hash of a block, read as a 256 bit number, must not be above the target of the
+// block. The chain starts with the targets of PowPerNoOpBlock and PowPerOpBlock leading
+// zero hex digits. With TargetBlockInterval set, every RetargetBlocks blocks both targets
+// are scaled by how long the last RetargetBlocks blocks took against how long they should
+// have taken, by at most maxRetargetFactor either way.
+
+const defaultRetargetBlocks = 10
+const maxRetargetFactor = 4
+const minDifficultyDigits = 1 // no retarget makes a no-op block easier than this
+
+var maxTarget = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+// target of hashes starting with the given number of zero hex digits
+func digitsTarget(digits int) *big.Int {
+	if digits <= 0 {
+		return new(big.Int).Set(maxTarget)
+	}
+	return new(big.Int).Rsh(maxTarget, uint(4*digits))
+}
+
+func meetsTarget(hash string, target *big.Int) bool {
+	value, ok := new(big.Int).SetString(hash, 16)
+	return ok && value.Cmp(target) <= 0
+}
+
+// easiest no-op target a retarget can reach: minDifficultyDigits, or the starting target
+// if that is easier still. It is never harder than the start, so a network too slow for
+// PowPerNoOpBlock can speed up.
+func retargetLimit() *big.Int {
+	limit := digitsTarget(minDifficultyDigits)
+	if start := digitsTarget(config.PowPerNoOpBlock); start.Cmp(limit) > 0 {
+		limit = start
+	}
+	return limit
+}
+
+// easiest target of any block, checked while the parent of a block is unknown. An op
+// block follows the no-op target, so its limit is the op target of retargetLimit.
+func powLimit() *big.Int {
+	limit := retargetLimit()
+	if op := opTarget(limit); op.Cmp(limit) > 0 {
+		limit = op
+	}
+	return limit
+}
+
+func retargetBlocks() int {
+	if config.RetargetBlocks > 0 {
+		return config.RetargetBlocks
+	}
+	return defaultRetargetBlocks
+}
+
+// target of a no-op block whose parent is the given block
+func nextTarget(parent *BlockNode) *big.Int {
+	window := retargetBlocks()
+	if config.TargetBlockInterval <= 0 || (parent.block.Index+1)%window != 0 {
+		return parent.target
+	}
+	first := parent
+	for i := 0; i < window && first != nil; i++ {
+		first = first.parent
+	}
+	if first == nil || first.parent == nil {
+		return parent.target // the genesis block has no timestamp to start from
+	}
+	expected := new(big.Int).Mul(big.NewInt(int64(window)), big.NewInt(int64(config.TargetBlockInterval)*int64(time.Second)))
+	actual := big.NewInt(parent.block.Timestamp - first.block.Timestamp)
+	if low := new(big.Int).Div(expected, big.NewInt(maxRetargetFactor)); actual.Cmp(low) < 0 {
+		actual = low
+	}
+	if high := new(big.Int).Mul(expected, big.NewInt(maxRetargetFactor)); actual.Cmp(high) > 0 {
+		actual = high
+	}
+	target := new(big.Int).Mul(parent.target, actual)
+	target.Div(target, expected)
+	if limit := retargetLimit(); target.Cmp(limit) > 0 {
+		target = limit
+	}
+	if target.Sign() <= 0 {
+		target = big.NewInt(1)
+	}
+	return target
+}
+
+// an op block needs PowPerOpBlock-PowPerNoOpBlock more zero hex digits than a no-op block
+func opTarget(noOpTarget *big.Int) *big.Int {
+	shift := 4 * (config.PowPerOpBlock - config.PowPerNoOpBlock)
+	if shift >= 0 {
+		return new(big.Int).Rsh(noOpTarget, uint(shift))
+	}
+	target := new(big.Int).Lsh(noOpTarget, uint(-shift))
+	if target.Cmp(maxTarget) > 0 {
+		return new(big.Int).Set(maxTarget)
+	}
+	return target
+}
 
+// target of block as a child of parent
+func blockTarget(parent *BlockNode, block *Block) *big.Int {
+	target := nextTarget(parent)
+	if len(block.Transactions) == 0 {
+		return target
 	}
-	// println("-------- End addChild ---------\n")
+	return opTarget(target)
+}
 
+// target of block before any retarget
+func configuredTarget(block *Block) *big.Int {
+	if len(block.Transactions) == 0 {
+		return digitsTarget(config.PowPerNoOpBlock)
+	}
+	return digitsTarget(config.PowPerOpBlock)
 }
 
-func (parent *BlockNode) findNode(prehash string) *BlockNode {
-	if prehash == parent.hashvalue {
-		return parent
+/*** END Difficulty ***/
+
+/*** Mining Engine ***/
+
+// A block is mined by several workers, each trying its own range of nonces. When no
+// nonce solves the block the ExtraNonce moves on and the nonces are tried again. The mining
+// is cancelled as soon as the canonical tip moves away from the parent of the block.
+
+// nonces a block can take
+var nonceSpace uint64 = math.MaxUint32 + 1
+
+var miningMutex sync.Mutex
+var miningParent string             // hash of the parent of the block being mined
+var cancelMining context.CancelFunc // gives up the block being mined
+var lastHashRate float64            // hashes per second of the last mining
+
+func miningWorkers() int {
+	if config.MiningThreads > 0 {
+		return config.MiningThreads
 	}
-	for _, node := range parent.blockChildren {
-		n := node.findNode(prehash)
-		if n != nil {
-			return n
+	return runtime.NumCPU()
+}
+
+// mineBlock sets the nonce and extra nonce of block to ones that solve the proof of
+// work, false if ctx is cancelled first
+func (bc *BlockChain) mineBlock(ctx context.Context, block *Block, target *big.Int) (uint32, bool) {
+	var hashes uint64
+	started := time.Now()
+	defer func() { recordHashRate(hashes, time.Since(started)) }()
+	for {
+		if nonce, found := bc.searchNonces(ctx, block, target, &hashes); found {
+			block.Nonce = nonce
+			return nonce, true
+		}
+		if ctx.Err() != nil {
+			return 0, false
 		}
+		block.ExtraNonce++ // every nonce failed
 	}
-	return nil
 }
 
-func printTreeNode(node BlockNode, suffix string) {
-	//transactions := convertJsonArray(node.block.Transactions)
-	if node.block.Transactions == "" {
-			fmt.Println(suffix+"---------")
-			println(suffix+"Index:", node.block.Index)
-			println(suffix+"Miner:", node.block.Miner)
-			println(suffix+"PrevHash:", node.block.PrevHash)
-			println(suffix+"Transaction: No-op")
-			fmt.Println(suffix+"---------")
-	} else {
-		fmt.Println(suffix+"==================================== TRANSACTION BLOCK ====================================")
-		println(suffix+"Index:", node.block.Index)
-		println(suffix+"Hashvalue:", node.hashvalue)
-		println(suffix+"PrevHash:", node.block.PrevHash)
-		println(suffix+"Timestamp:", node.block.Timestamp)
-		println(suffix+"Miner:", node.block.Miner)
-		println(suffix+"Nonce:", node.block.Nonce)
-		jsons := convertJsonArray(node.block.Transactions)
-		println(suffix+"_____________TRANSACTIONS_____________")
-		for i := 0; i < len(jsons); i++ {
-			json := jsons[i]
-			println(suffix+"#{")
-			println(suffix+json["filename"])
-			println(suffix+json["content"])
-			println(suffix+json["op"])
-			println(suffix+"}#")
+// searchNonces tries every nonce of block on the workers and adds the hashes it took
+func (bc *BlockChain) searchNonces(ctx context.Context, block *Block, target *big.Int, hashes *uint64) (uint32, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	workers := uint64(miningWorkers())
+	span := nonceSpace / workers
+	found := make(chan uint32, workers)
+	var wg sync.WaitGroup
+	for w := uint64(0); w < workers; w++ {
+		first, last := w*span, (w+1)*span
+		if w == workers-1 {
+			last = nonceSpace
 		}
-		println(suffix+"END TRANSACTIONS")
-		fmt.Println(suffix+"============================================================================================")
+		wg.Add(1)
+		go func(candidate BlockHeader, first uint64, last uint64) {
+			defer wg.Done()
+			count := uint64(0)
+			defer func() { atomic.AddUint64(hashes, count) }()
+			for nonce := first; nonce < last; nonce++ {
+				if count%1024 == 0 && ctx.Err() != nil {
+					return
+				}
+				candidate.Nonce = uint32(nonce)
+				count++
+				if meetsTarget(hashHeader(&candidate), target) {
+					found <- candidate.Nonce
+					cancel()
+					return
+				}
+			}
+		}(block.header(), first, last)
 	}
-	println(suffix + "Children:")
-	for i := 0; i < len(node.blockChildren); i++ {
-		child := node.blockChildren[i]
-		createIndent := ""
-		if(i > 0){
-			createIndent = "\t"
+	wg.Wait()
+	select {
+	case nonce := <-found:
+		return nonce, true
+	default:
+		return 0, false
+	}
+}
+
+func recordHashRate(hashes uint64, elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+	miningMutex.Lock()
+	lastHashRate = float64(hashes) / elapsed.Seconds()
+	miningMutex.Unlock()
+}
+
+// hashes per second of the last mined or given up block
+func hashRate() float64 {
+	miningMutex.Lock()
+	defer miningMutex.Unlock()
+	return lastHashRate
+}
+
+// startMining gives the context for mining a block on parent, it is cancelled once the
+// canonical tip is another block
+func startMining(parent *BlockNode) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	miningMutex.Lock()
+	miningParent = parent.hashvalue
+	cancelMining = cancel
+	miningMutex.Unlock()
+	if longestTip() != parent {
+		cancel() // the tip moved before the handler could see it
+	}
+	return ctx
+}
+
+func stopMining() {
+	miningMutex.Lock()
+	defer miningMutex.Unlock()
+	if cancelMining != nil {
+		cancelMining()
+		cancelMining = nil
+	}
+	miningParent = ""
+}
+
+func cancelStaleMining(event ReorgEvent) {
+	miningMutex.Lock()
+	defer miningMutex.Unlock()
+	if cancelMining != nil && event.NewTip.hashvalue != miningParent {
+		cancelMining()
+	}
+}
+
+/*** END Mining Engine ***/
+
+/*** Hasher ***/
+
+// Hasher hashes blocks for the proof of work and the block tree. Every miner of a
+// network must use the same one, it is picked by HashFunction in the config.
+type Hasher interface {
+	Name() string
+	Sum(data []byte) string // hex of the digest
+}
+
+type digestHasher struct {
+	name   string
+	digest func(data []byte) []byte
+}
+
+func (h digestHasher) Name() string {
+	return h.name
+}
+
+func (h digestHasher) Sum(data []byte) string {
+	return hex.EncodeToString(h.digest(data))
+}
+
+var hashers = map[string]Hasher{
+	"sha256": digestHasher{"sha256", func(data []byte) []byte {
+		sum := sha256.Sum256(data)
+		return sum[:]
+	}},
+	"sha3": digestHasher{"sha3", func(data []byte) []byte {
+		sum := sha3.Sum256(data)
+		return sum[:]
+	}},
+	"blake2b": digestHasher{"blake2b", func(data []byte) []byte {
+		sum := blake2b.Sum256(data)
+		return sum[:]
+	}},
+}
+
+var blockHasher = hashers["sha256"]
+
+func selectHasher(name string) (Hasher, error) {
+	if name == "" {
+		name = "sha256"
+	}
+	hasher, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown HashFunction %q", name)
+	}
+	return hasher, nil
+}
+
+// chainID names the chain of this miner by its hasher and the hash of its genesis
+// block, which covers GenesisBlockHash. Miners refuse blocks and sync of another chain.
+func chainID() string {
+	return blockHasher.Name() + "/" + root.hashvalue
+}
+
+/*** END Hasher ***/
+
+/*** Operation IDs ***/
+
+// An operation is named by a random 128 bit id, so a restarted miner never reuses the
+// id of an operation it sent before. Queues, blocks and confirmations know an operation
+// by opKey, the MinerID and the id.
+
+func newOperationID() string {
+	var id [16]byte
+	if _, err := cryptorand.Read(id[:]); err != nil {
+		log.Fatal("Fail to generate an operation id: ", err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+/*** END Operation IDs ***/
+
+/*** Miner Identity ***/
+
+// Every miner has an ed25519 key pair, its MinerID is the hex of the public key, so
+// anyone can check an operation was signed by the miner that pays for it. The seed
+// of the key is kept in KeyFile (default <data dir>/miner.key) and created on the
+// first start. The MinerID of config.json is only a name for the data directory.
+
+var minerName string
+var minerKey ed25519.PrivateKey
+
+// directory of the block store and the key of this miner
+func dataDir() string {
+	if config.BlockStoreDir != "" {
+		return config.BlockStoreDir
+	}
+	return filepath.Join("data", minerName)
+}
+
+func loadMinerKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s is not an ed25519 seed", path)
 		}
-		println(suffix + "\t" + strconv.Itoa(i))
-		printTreeNode(*child, suffix + createIndent)
-		println()
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
 	}
+	if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
 }
 
-func (root *BlockNode) printTree() {
-	println("---------------------- Tree ------------------------------")
-	printTreeNode(*root, "")
-	println("---------------------- End Tree --------------------------")
+// load the key of this miner and take the MinerID it gives
+func loadIdentity() {
+	minerName = config.MinerID
+	path := config.KeyFile
+	if path == "" {
+		path = filepath.Join(dataDir(), "miner.key")
+	}
+	key, err := loadMinerKey(path)
+	if err != nil {
+		log.Fatal("Fail to load miner key: ", err)
+	}
+	minerKey = key
+	config.MinerID = minerIDOfKey(key.Public().(ed25519.PublicKey))
+	fmt.Printf("MinerID of %s: %s\n", minerName, config.MinerID)
 }
 
-// Block is a single structure in the chain
-type Block struct {
-	PrevHash     string
-	Index        int   // the position in blockchain
-	Timestamp    int64 // nanoseconds elapsed since January 1, 1970 UTC.
-	Nonce        uint32
-	Miner        string
-	Transactions string
+func minerIDOfKey(key ed25519.PublicKey) string {
+	return hex.EncodeToString(key)
 }
 
-// BlockChain is the central datastructure
-type BlockChain struct {
-	chainLock    *sync.Mutex
-	chain        []*Block
-	maxRecordNum int
-	difficulty   int
+func publicKeyOfMiner(minerID string) (ed25519.PublicKey, bool) {
+	key, err := hex.DecodeString(minerID)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, false
+	}
+	return ed25519.PublicKey(key), true
+}
+
+// the bytes of the operation covered by its signature
+func operationBytes(opmsg *OpMsg) []byte {
+	var buf bytes.Buffer
+	writeLengthPrefixed(&buf, []byte(opmsg.Op))
+	writeLengthPrefixed(&buf, []byte(opmsg.Name))
+	writeLengthPrefixed(&buf, opmsg.Content)
+	writeLengthPrefixed(&buf, []byte(opmsg.MinerID))
+	writeLengthPrefixed(&buf, []byte(opmsg.ID))
+	return buf.Bytes()
+}
+
+func signOperation(opmsg *OpMsg) {
+	opmsg.Signature = ed25519.Sign(minerKey, operationBytes(opmsg))
+}
+
+// the operation is signed by the key its MinerID is made of
+func verifyOperation(opmsg *OpMsg) bool {
+	key, ok := publicKeyOfMiner(opmsg.MinerID)
+	if !ok || len(opmsg.Signature) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(key, operationBytes(opmsg), opmsg.Signature)
+}
+
+// the miner signs the hash of the block, which covers every field but the signature
+func signBlock(block *Block) {
+	block.Signature = ed25519.Sign(minerKey, []byte(minerChain.hashBlock(block)))
+}
+
+// the block is signed by the key its Miner is made of
+func verifyBlockSignature(block *Block) bool {
+	header := block.header()
+	return verifyHeaderSignature(&header)
+}
+
+func verifyHeaderSignature(header *BlockHeader) bool {
+	key, ok := publicKeyOfMiner(header.Miner)
+	if !ok || len(header.Signature) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(key, []byte(hashHeader(header)), header.Signature)
+}
+
+/*** END Miner Identity ***/
+
+/*** Orphan Pool ***/
+
+// Blocks flooded over a mesh can arrive before their parent. They wait here, keyed by
+// the hash of the missing parent, until the parent is added to the tree. The pool
+// holds at most maxOrphanBlocks and drops blocks older than orphanTimeout.
+
+const maxOrphanBlocks = 512
+const orphanTimeout = 10 * time.Minute
+
+type orphanBlock struct {
+	block    Block
+	hash     string
+	from     string // the peer which sent it
+	received time.Time
+}
+
+var orphanMutex sync.Mutex
+var orphans = make(map[string][]*orphanBlock) // missing parent hash -> blocks waiting for it
+var orphanHashes = make(map[string]bool)      // hashes of all the orphans
+
+// addOrphan keeps the block until its parent arrives, returns false if it is already kept
+func addOrphan(block Block, from string) bool {
+	hash := minerChain.hashBlock(&block)
+	orphanMutex.Lock()
+	defer orphanMutex.Unlock()
+	if orphanHashes[hash] {
+		return false
+	}
+	expireOrphans()
+	orphan := &orphanBlock{block, hash, from, time.Now()}
+	orphans[block.PrevHash] = append(orphans[block.PrevHash], orphan)
+	orphanHashes[hash] = true
+	return true
+}
+
+// drop the orphans which waited too long, then the oldest ones while the pool is full.
+// The caller holds orphanMutex.
+func expireOrphans() {
+	now := time.Now()
+	for {
+		var oldest *orphanBlock
+		for _, list := range orphans {
+			for _, orphan := range list {
+				if now.Sub(orphan.received) > orphanTimeout {
+					removeOrphan(orphan)
+				} else if oldest == nil || orphan.received.Before(oldest.received) {
+					oldest = orphan
+				}
+			}
+		}
+		if oldest == nil || len(orphanHashes) < maxOrphanBlocks {
+			break
+		}
+		removeOrphan(oldest)
+	}
+}
+
+// The caller holds orphanMutex.
+func removeOrphan(orphan *orphanBlock) {
+	list := orphans[orphan.block.PrevHash]
+	for i, other := range list {
+		if other == orphan {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(orphans, orphan.block.PrevHash)
+	} else {
+		orphans[orphan.block.PrevHash] = list
+	}
+	delete(orphanHashes, orphan.hash)
+}
+
+// takeOrphans removes and returns the blocks waiting for the parent with the given hash
+func takeOrphans(parentHash string) []*orphanBlock {
+	orphanMutex.Lock()
+	defer orphanMutex.Unlock()
+	list := orphans[parentHash]
+	delete(orphans, parentHash)
+	for _, orphan := range list {
+		delete(orphanHashes, orphan.hash)
+	}
+	return list
+}
+
+// the block with hash was added to the tree, add the orphans waiting for it, and theirs in turn
+func adoptOrphans(hash string) {
+	for _, orphan := range takeOrphans(hash) {
+		receiveBlock(&orphan.block, orphan.from)
+	}
 }
 
-func (bc *BlockChain) init() {
-	OpHashMap = make([]string, 0)
-	// create genesis block
-	block := &Block{}
-	block.PrevHash = config.GenesisBlockHash
-	block.Nonce = 0
-	bc.chain = append(bc.chain, block)
-	fmt.Println("Genisis block created.")
+/*** END Orphan Pool ***/
 
-	// tree
-	root = BlockNode{*block, minerChain.hashBlock(block), nil, nil} // initial tree
+/*** File State ***/
 
-	longestMutex.Lock()
-	longestChainNodes = append(longestChainNodes, &root)
-	maxLength = 0
-	longestMutex.Unlock()
+// Every BlockNode has the files of the chain ending at it, so a query on a tip does
+// not walk the chain. The state of a child is its parent's state plus the
+// transactions of its block. Tries are copied only along the changed path, so forks
+// share everything they have in common and a reorg just means reading another tip.
 
-	//bc.manageChain()
+const trieBits = 4
+const trieWidth = 1 << trieBits
+const fileTrieDepth = 64 / trieBits   // key is the fnv hash of the filename
+const recordTrieDepth = 16 / trieBits // key is the uint16 position of the record
+const maxRecordsPerFile = 65535
+
+// ptrie is a persistent trie indexed by the trieBits digits of a key
+type ptrie struct {
+	children [trieWidth]*ptrie
+	value    interface{}
 }
 
-func startBlockGeneration() {
-	ticker := time.NewTicker(time.Duration(config.GenOpBlockTimeout) * time.Second)
-	for range ticker.C {
-		createTransactionBlock()
+func (t *ptrie) get(key uint64, depth int) interface{} {
+	for level := depth - 1; level >= 0 && t != nil; level-- {
+		t = t.children[(key>>(uint(level)*trieBits))&(trieWidth-1)]
 	}
+	if t == nil {
+		return nil
+	}
+	return t.value
 }
 
-func printLedge() {
-	longestMutex.Lock()
-	lastblock := longestChainNodes[rand.Int()%len(longestChainNodes)] // pick the longest chain randomly
-	longestMutex.Unlock()
-	ledge := getLedge(lastblock)
-	println("--------- Ledge -------------")
-	for k, v := range ledge {
-		fmt.Printf("| %s\t%d\n", k, v)
+// set returns a trie with value at key, t itself is never modified
+func (t *ptrie) set(key uint64, depth int, value interface{}) *ptrie {
+	var copied ptrie
+	if t != nil {
+		copied = *t
 	}
-	println("--------- End Ledge ---------")
+	if depth == 0 {
+		copied.value = value
+		return &copied
+	}
+	digit := (key >> (uint(depth-1) * trieBits)) & (trieWidth - 1)
+	copied.children[digit] = copied.children[digit].set(key, depth-1, value)
+	return &copied
 }
 
-func getLedge(blocknode *BlockNode) map[string]int {
-	ledge := make(map[string]int)
-	for {
-		if blocknode.parent == nil {
-			return ledge
-		}
-		transactions := convertJsonArray(blocknode.block.Transactions)
-		blockMinerID := blocknode.block.Miner
-		if _, ok := ledge[blockMinerID]; !ok {
-			ledge[blockMinerID] = 0
-		}
-
-		if blocknode.block.Transactions == "" {
-			ledge[blockMinerID] += config.MinedCoinsPerNoOpBlock
-		} else {
-			ledge[blockMinerID] += config.MinedCoinsPerOpBlock
-		}
+// fileEntry is immutable, an append creates a new entry
+type fileEntry struct {
+	name         string
+	creator      string // the miner whose client created the file
+	createdBy    string // opKey of the CreateFile
+	createdIndex int    // index of the block with the CreateFile
+	numRecs      int
+	records      *ptrie // position -> content
+}
 
-		for _, json := range transactions {
-			minerID := json["minerId"]
-			if _, ok := ledge[minerID]; !ok {
-				ledge[minerID] = 0
-			}
-			if json["op"] == "CreateFile" {
-				ledge[minerID] -= config.NumCoinsPerFileCreate
-			} else if json["op"] == "AppendRec" {
-				ledge[minerID]-- //just one coin
-			}
-		}
-		blocknode = blocknode.parent
-	}
+func (entry *fileEntry) record(pos int) []byte {
+	content, _ := entry.records.get(uint64(pos), recordTrieDepth).([]byte)
+	return content
 }
 
-func checkBalance(operationMsg OpMsg) bool {
-	longestMutex.Lock()
-	lastblock := longestChainNodes[rand.Int()%len(longestChainNodes)] // pick the longest chain randomly
-	longestMutex.Unlock()
-	ledge := getLedge(lastblock)
+type nameList struct {
+	name string
+	next *nameList
+}
 
-	minerID := operationMsg.MinerID
+type fileState struct {
+	files *ptrie    // fnv hash of the name -> []*fileEntry with that hash
+	names *nameList // every file once, the newest first
+	ops   *ptrie    // fnv hash of the opKey -> []string of the opKeys in the chain with that hash
+}
 
-	if _, ok := ledge[minerID]; !ok {
-		// println("@@@@@@@@@@@@")
-		// fmt.Printf("%v\n", operationMsg)
-		// println("Now", minerID, "balance is", 0)
-		// println("@@@@@@@@@@@@")
+func fileKey(name string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	return hash.Sum64()
+}
 
-		return false
+func (state *fileState) file(name string) *fileEntry {
+	bucket, _ := state.files.get(fileKey(name), fileTrieDepth).([]*fileEntry)
+	for _, entry := range bucket {
+		if entry.name == name {
+			return entry
+		}
 	}
+	return nil
+}
 
-	// println("@@@@@@@@@@@@")
-	// fmt.Printf("%v\n", operationMsg)
-	// println("Now", minerID, "balance is", ledge[minerID])
-	// println("@@@@@@@@@@@@")
-
-	if operationMsg.Op == "CreateFile" {
-		if ledge[minerID] < config.NumCoinsPerFileCreate {
-			return false
+// withFile returns a state with entry added or replacing the entry of the same name
+func (state *fileState) withFile(entry *fileEntry) *fileState {
+	key := fileKey(entry.name)
+	old, _ := state.files.get(key, fileTrieDepth).([]*fileEntry)
+	bucket := make([]*fileEntry, 0, len(old)+1)
+	isNew := true
+	for _, other := range old {
+		if other.name == entry.name {
+			isNew = false
+			continue
 		}
-		return true
+		bucket = append(bucket, other)
 	}
-	if operationMsg.Op == "AppendRec" {
-		if ledge[minerID] < 1 {
-			return false
+	bucket = append(bucket, entry)
+	next := &fileState{state.files.set(key, fileTrieDepth, bucket), state.names, state.ops}
+	if isNew {
+		next.names = &nameList{entry.name, state.names}
+	}
+	return next
+}
+
+// the operation with the key is in a block of the chain, including it again is a replay
+func (state *fileState) hasOperation(key string) bool {
+	bucket, _ := state.ops.get(fileKey(key), fileTrieDepth).([]string)
+	for _, other := range bucket {
+		if other == key {
+			return true
 		}
-		return true
 	}
 	return false
 }
 
-// This function should only occur when the chain is locked.
-func (bc *BlockChain) verifyBlock(block *Block) (isValidBlock bool) {
-	var difficulty int
-	if block.Transactions == "" {
-		difficulty = config.PowPerNoOpBlock
-	} else {
-		difficulty = config.PowPerOpBlock
-	}
-	numberOfZeros := strings.Repeat("0", difficulty)
-	blockHash := bc.hashBlock(block)
-	parent := root.findNode(block.PrevHash)
-	if parent == nil {
-		return false
-	}
-	hasCorrectHash := strings.HasSuffix(blockHash, numberOfZeros)
-	if !hasCorrectHash {
-		fmt.Println("BlockHash:\t", blockHash)
-		fmt.Println("BlockNonce:\t", block.Nonce)
-		fmt.Println("Hint: Incorrect hash")
-		return false
-	}
-	println(block.Transactions)
-	if block.Transactions == "" {
-		return true
-	}
-	// validate all the transactions
-	ledge := getLedge(parent)
-	transactions := convertJsonArray(block.Transactions)
-	for i := 0; i < len(transactions); i++ {
-		// add up coin balances
-		json := transactions[i]
-		if _, ok := ledge[json["minerId"]]; !ok {
-			return false
-		}
-		if json["op"] == "CreateFile" {
-			if ledge[json["minerId"]] < config.NumCoinsPerFileCreate {
-				return false
-			}
-			ledge[json["minerId"]] -= config.NumCoinsPerFileCreate
-		}
-		if json["op"] == "AppendRec" {
-			if ledge[json["minerId"]] < 1 {
-				return false
-			}
-			ledge[json["minerId"]]--
-		}
+func (state *fileState) withOperation(key string) *fileState {
+	hash := fileKey(key)
+	old, _ := state.ops.get(hash, fileTrieDepth).([]string)
+	bucket := append(append(make([]string, 0, len(old)+1), old...), key)
+	return &fileState{state.files, state.names, state.ops.set(hash, fileTrieDepth, bucket)}
+}
+
+// apply returns the state after the transactions of block
+func (state *fileState) apply(block *Block) *fileState {
+	for i := range block.Transactions {
+		state = state.applyTransaction(&block.Transactions[i], block.Index)
 	}
-	return true
+	return state
 }
 
-func checkRecordInChain(record *OpMsg, node *BlockNode) bool {
-	var str string
-	if record.Op == "CreateFile" {
-		str = record.Op + "{,}" + record.Name
-	} else {
-		str = record.Op + "{,}" + record.Name + "{,}" + record.Content + "{,}" + record.MinerID + "{,}" + strconv.Itoa(int(record.MsgID))
+// the files after tx of the block at index, a transaction breaking the rules changes nothing
+func (state *fileState) applyTransaction(tx *Transaction, index int) *fileState {
+	key := opKey(tx.opMsg())
+	if state.hasOperation(key) {
+		return state
 	}
-	for {
-		if node.parent == nil {
-			return false
+	switch tx.Op {
+	case "CreateFile":
+		if state.file(tx.FileName) != nil {
+			return state
 		}
-		if strings.Contains(node.block.Transactions, str) == true {
-			return true
+		state = state.withFile(&fileEntry{name: tx.FileName, creator: tx.MinerID, createdBy: key, createdIndex: index})
+	case "AppendRec":
+		entry := state.file(tx.FileName)
+		if entry == nil || entry.numRecs >= maxRecordsPerFile {
+			return state
 		}
-		node = node.parent
-	}
+		updated := *entry
+		updated.records = entry.records.set(uint64(entry.numRecs), recordTrieDepth, tx.Content)
+		updated.numRecs++
+		state = state.withFile(&updated)
+	default:
+		return state
+	}
+	return state.withOperation(key)
 }
 
-// when timeout, you just use API createBlock
-// the function will read records from the queue
-// and generate a new block
-func createTransactionBlock() {
-	// set prev hash
-	block := &Block{}
+/*** END File State ***/
 
-	longestMutex.Lock()
-	lastblock := longestChainNodes[rand.Int()%len(longestChainNodes)] // pick the longest chain randomly
-	block.Index = lastblock.block.Index + 1
-	longestMutex.Unlock()
+/*** Block Store ***/
 
-	block.PrevHash = lastblock.hashvalue
+// The block store keeps every block attached to the tree in an append-only log
+// split into segments, so that a restarted miner rebuilds its tree from disk and
+// only asks its peers for the blocks it has missed. Each entry of a segment is
+// [4 bytes length][4 bytes crc32][json of the Block]. The index file has one
+// line "hash segment offset" per block.
 
-	// block.Transactions = bc.txBuffer
-	block.Timestamp = makeTimestamp()
-	block.Miner = config.MinerID
+const maxSegmentSize = 16 * 1024 * 1024 // roll over to a new segment after 16MB
+const blockFrameHeader = 8
 
-	var transactionNum int
+type blockLocation struct {
+	segment int
+	offset  int64
+}
 
-	for {
-		if len(recordQueue) == 0 {
-			break //note
-		}
-		if checkBalance(*recordQueue[0]) == false {
-			break
-		} // no-op block
+// BlockStore is the on-disk copy of the block tree
+type BlockStore struct {
+	mutex     sync.Mutex
+	dir       string
+	segmentID int
+	segment   *os.File
+	offset    int64 // end of the current segment
+	indexFile *os.File
+	index     map[string]blockLocation // block hash -> where it is in the segments
+}
 
-		record := popRecordQueue()
-		if checkRecordInChain(record, lastblock) == true {
-			str := record.Op + "{,}" + record.Name + "{,}" + record.Content + "{,}" + record.MinerID + "{,}" + strconv.Itoa(int(record.MsgID))
-			printColorFont("red", config.MinerID+" "+str+" "+lastblock.block.Transactions)
-			continue
-		} else {
-			if len(block.Transactions) == 0 {
-				block.Transactions = record.Op + "{,}" + record.Name + "{,}" + record.Content + "{,}" + record.MinerID + "{,}" + strconv.Itoa(int(record.MsgID))
-			} else {
-				block.Transactions += "{;}" + record.Op + "{,}" + record.Name + "{,}" + record.Content + "{,}" + record.MinerID + "{,}" + strconv.Itoa(int(record.MsgID))
-			}
-			transactionNum++
-		}
-		if transactionNum == minerChain.maxRecordNum {
-			break
-		}
-	}
+var blockStore *BlockStore
 
-	// it's not right, just for convenience
-	if transactionNum == 0 {
-		if disableNoOp == true {
-			return
+func segmentPath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("segment-%06d.log", id))
+}
+
+// list the ids of the segments in dir in ascending order
+func listSegments(dir string) ([]int, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0)
+	for _, name := range names {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(name), "segment-%06d.log", &id); err == nil {
+			ids = append(ids, id)
 		}
 	}
+	sort.Ints(ids)
+	return ids, nil
+}
 
-	// mine the block to find solution
-	block.Nonce = minerChain.proofOfWork(block)
-
-	// println("***************** Found Solution for block: ")
-	// // fmt.Printf("* Block Info\n")
-	// println("*Index:", block.Index)
-	// // println("*Miner:", block.Miner)
-	// // println("*Transaction:", block.Transactions)
-	// println("*Nonce:", block.Nonce)
-	// println("***************** end solution.")
+func openBlockStore(dir string) (*BlockStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	store := &BlockStore{dir: dir, index: make(map[string]blockLocation)}
+	if err := checkStoreChain(dir); err != nil {
+		return nil, err
+	}
 
-	// add to own chain first before broadcasting.
-	pushBlockQueue(block)
+	indexFile, err := os.OpenFile(filepath.Join(dir, "index"), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	store.indexFile = indexFile
+	scanner := bufio.NewScanner(indexFile)
+	for scanner.Scan() {
+		var hash string
+		var loc blockLocation
+		if _, err := fmt.Sscanf(scanner.Text(), "%s %d %d", &hash, &loc.segment, &loc.offset); err == nil {
+			store.index[hash] = loc
+		}
+	}
 
-	root.addChild(*block)
-	broadcastBlocks(block)
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		store.segmentID = segments[len(segments)-1]
+	}
+	if err := store.openSegment(store.segmentID); err != nil {
+		return nil, err
+	}
+	return store, nil
 }
 
-func (bc *BlockChain) proofOfWork(block *Block) (Nonce uint32) {
-// println("Working on block...")
-	Nonce = block.Nonce
-	str := bc.hashBlock(block)
-	for {
-		var difficulty int
-		if block.Transactions == "" {
-			difficulty = config.PowPerNoOpBlock
-		} else {
-			difficulty = config.PowPerOpBlock
+// the blocks of a store are only valid on the chain they were written for, hashes of
+// another hasher or genesis block don't link up. A store without a chain file was
+// written before the hasher could be chosen.
+func checkStoreChain(dir string) error {
+	path := filepath.Join(dir, "chain")
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if stored := strings.TrimSpace(string(data)); stored != chainID() {
+			return fmt.Errorf("%s holds blocks of chain %s, this miner is on chain %s, remove it to start again", dir, stored, chainID())
 		}
-		numberOfZeros := strings.Repeat("0", difficulty)
-		foundSolution := strings.HasSuffix(str, numberOfZeros)
-		if foundSolution {
-			break
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	for _, id := range segments {
+		if info, err := os.Stat(segmentPath(dir, id)); err == nil && info.Size() > 0 {
+			return fmt.Errorf("%s holds blocks of an older chain (md5), remove it to start again", dir)
 		}
-		Nonce++
-		block.Nonce = Nonce
-		str = bc.hashBlock(block)
 	}
-	// fmt.Println("Found Solution: (prevhash/currhash/nonce) ")
-	// fmt.Println("PrevHash", block.PrevHash)
-	// fmt.Println("currhash", str)
-	// fmt.Println("Nonce:", Nonce)
-	// println("-----------End ProofOfWork-----------")
-	println()
-	return Nonce
+	return ioutil.WriteFile(path, []byte(chainID()+"\n"), 0644)
 }
 
-func (bc *BlockChain) hashBlock(block *Block) (str string) {
-	hash := md5.New()
-	blockData := bc.getBlockBytes(block)
-	hash.Write(blockData)
-	str = hex.EncodeToString(hash.Sum(nil))
-	return str
-}
-
-func (bc *BlockChain) getBlockBytes(block *Block) []byte {
-	data := bytes.Join(
-		[][]byte{
-			[]byte(block.PrevHash),
-			[]byte(fmt.Sprint(strconv.Itoa(block.Index))),
-			[]byte(strconv.FormatInt(block.Timestamp, 10)),
-			[]byte(fmt.Sprint(block.Nonce)),
-			[]byte(block.Transactions),
-		},
-		[]byte{},
-	)
-	return data
+// open the segment with id for appending
+func (store *BlockStore) openSegment(id int) error {
+	segment, err := os.OpenFile(segmentPath(store.dir, id), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	offset, err := segment.Seek(0, io.SeekEnd)
+	if err != nil {
+		segment.Close()
+		return err
+	}
+	store.segmentID = id
+	store.segment = segment
+	store.offset = offset
+	return nil
 }
 
-func convertJsonArray(transaction string) []map[string]string {
-	res := make([]map[string]string, 0)
-	if len(transaction) == 0 {
-		return res
-	}
-	recordList := strings.Split(transaction, "{;}")
-	for _, record := range recordList {
-		elements := strings.Split(record, "{,}")
-		json := make(map[string]string)
-		json["op"] = elements[0]
-		if json["op"] == "No-Op" {
-			json["filename"] = ""
-			json["content"] = ""
-			json["minerId"] = elements[3]
-			json["msgid"] = elements[4]
-		} else {
-			json["filename"] = elements[1]
-			json["content"] = elements[2]
-			json["minerId"] = elements[3]
-			json["msgid"] = elements[4]
-		}
-		res = append(res, json)
+// tornFrameError : the frame was cut short by a crash or its bytes are damaged
+type tornFrameError struct {
+	offset int64
+	reason string
+}
+
+func (err *tornFrameError) Error() string {
+	return fmt.Sprintf("block store: torn frame at offset %d: %s", err.offset, err.reason)
+}
+
+// read the frame at offset of a segment of size bytes, returns its data and the
+// offset of the next frame
+func readFrame(file *os.File, offset int64, size int64) ([]byte, int64, error) {
+	if offset+blockFrameHeader > size {
+		return nil, offset, &tornFrameError{offset, "short header"}
 	}
-	return res
+	header := make([]byte, blockFrameHeader)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return nil, offset, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > maxSegmentSize {
+		return nil, offset, &tornFrameError{offset, fmt.Sprintf("length %d", length)}
+	}
+	if offset+blockFrameHeader+int64(length) > size {
+		return nil, offset, &tornFrameError{offset, "short body"}
+	}
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset+blockFrameHeader); err != nil {
+		return nil, offset, err
+	}
+	if crc32.ChecksumIEEE(data) != checksum {
+		return nil, offset, &tornFrameError{offset, "bad checksum"}
+	}
+	return data, offset + blockFrameHeader + int64(length), nil
 }
 
-func (bc *BlockChain) validateTransactions(fileName string, opType string, content string) (valid bool) {
-	for _, block := range bc.chain {
-		jsons := convertJsonArray(block.Transactions)
-		for i := 0; i < len(jsons); i++ {
-			json := jsons[i]
-			if json["op"] == opType && json["filename"] == fileName && json["content"] == content && json["op"] != "AppendRec" && json["op"] != "No-Op" {
-				return false
+// replay calls visit for every stored block in the order they were appended, which
+// guarantees a parent is visited before its children. A torn frame at the end of
+// the last segment (crash while writing) is cut off, so new blocks follow the last
+// whole one. A whole frame whose block can't be decoded is skipped.
+func (store *BlockStore) replay(visit func(block Block)) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	segments, err := listSegments(store.dir)
+	if err != nil {
+		return err
+	}
+	for _, id := range segments {
+		file, err := os.Open(segmentPath(store.dir, id))
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		size := info.Size()
+		var offset int64
+		for offset < size {
+			data, next, err := readFrame(file, offset, size)
+			if _, torn := err.(*tornFrameError); torn {
+				if id == store.segmentID {
+					printColorFont("red", fmt.Sprintf("%v, truncate segment %d there", err, id))
+					store.segment.Truncate(offset)
+					store.offset = offset
+				} else {
+					printColorFont("red", fmt.Sprintf("%v, skip the rest of segment %d", err, id))
+				}
+				break
+			}
+			if err != nil {
+				file.Close()
+				return err
 			}
+			block := &Block{}
+			if err := json.Unmarshal(data, block); err != nil {
+				printColorFont("red", fmt.Sprintf("block store: skip block of segment %d at offset %d: %v", id, offset, err))
+				offset = next
+				continue
+			}
+			hash := minerChain.hashBlock(block)
+			if _, ok := store.index[hash]; !ok {
+				// the index line was lost, write it again
+				store.index[hash] = blockLocation{id, offset}
+				fmt.Fprintf(store.indexFile, "%s %d %d\n", hash, id, offset)
+			}
+			visit(*block)
+			offset = next
 		}
+		file.Close()
 	}
-	return true
+	return nil
 }
 
-func Initial() {
-	blockFile = make(map[string]string)
-	recordQueue = make([]*OpMsg, 0)
-	recordTrash = make([]*OpMsg, 0)
-	blockQueue = make([]*Block, 0)
-	minerChain = &BlockChain{
-		chainLock:    &sync.Mutex{},
-		chain:        make([]*Block, 0),
-		maxRecordNum: 2, // the maximum records in one block
-		difficulty:   5,
+// append writes the block at the end of the current segment unless it is already stored
+func (store *BlockStore) append(hash string, block *Block) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.index[hash]; ok {
+		return nil
 	}
-	minerChain.init()
+	data, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	if store.offset > 0 && store.offset+blockFrameHeader+int64(len(data)) > maxSegmentSize {
+		store.segment.Close()
+		if err := store.openSegment(store.segmentID + 1); err != nil {
+			return err
+		}
+	}
+	frame := make([]byte, blockFrameHeader+len(data))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(data))
+	copy(frame[blockFrameHeader:], data)
+	if _, err := store.segment.WriteAt(frame, store.offset); err != nil {
+		return err
+	}
+	if err := store.segment.Sync(); err != nil {
+		return err
+	}
+	loc := blockLocation{store.segmentID, store.offset}
+	store.offset += int64(len(frame))
+	store.index[hash] = loc
+	_, err = fmt.Fprintf(store.indexFile, "%s %d %d\n", hash, loc.segment, loc.offset)
+	return err
+}
 
-	rand.Seed(time.Now().Unix())
+// open the block store of this miner and rebuild the tree from it
+func loadBlockStore() {
+	dir := dataDir()
+	store, err := openBlockStore(dir)
+	if err != nil {
+		log.Fatal("Fail to open block store: ", err)
+	}
+	count := 0
+	err = store.replay(func(block Block) {
+		if root.attachChild(block) != nil {
+			count++
+		}
+	})
+	if err != nil {
+		log.Fatal("Fail to replay block store: ", err)
+	}
+	blockStore = store
+	fmt.Printf("Replayed %d blocks from %s, longest chain: %d\n", count, dir, longestTip().block.Index)
 }
 
-/*** END Blockchain ***/
+/*** END Block Store ***/
 
 var disableNoOp bool
 
@@ -1259,7 +3611,10 @@ func main() {
 	Initial()
 
 	go listenMiner() // Open a port to listen msg from miners
+	go heartbeat()   // keep a connection to every peer
+	go peerDiscovery()
 	synchronization()
+	go syncManager()  // catch up with the peers from now on
 	go listenClient() // Open a port to listen msg from clients
 	go startBlockGeneration()
 	// disableNoOp = true
@@ -1273,41 +3628,26 @@ func main() {
 			showfiles()
 		} else if strings.Contains(text, "rpcdemo") == true {
 			// demo : inform neiboring peers
-			for _, ip := range config.PeerMinersAddrs {
+			for _, ip := range peerAddrs() {
 				sendMiner(ip, ClientMsg{config.MinerID + " says hello ", config.MinerID})
 			}
 		} else if strings.Contains(text, "rqueue") == true {
 			printRecordQueue()
-		} else if strings.Contains(text, "bqueue") == true {
-			printBlockQueue()
 		} else if strings.Contains(text, "pop") == true {
 			rec := popRecordQueue()
 			if rec == nil {
 				println("The queue is empty")
 			}
 		} else if strings.Contains(text, "floodblock") == true {
-			broadcastBlocks(&Block{"Hello", 0, 0, 65535, "Miner", "A,B,C,D"})
+			broadcastBlocks(&Block{"Hello", 0, 0, 65535, 0, "Miner", []Transaction{{"A", "B", []byte("C"), "D", "", nil}}, nil})
 		} else if strings.Contains(text, "createblock") == true {
 			createTransactionBlock()
 		} else if strings.Contains(text, "ledge") == true {
 			printLedge()
-		} else if strings.Contains(text, "test") == true {
-			s := convertJsonArray("CreateFile{,}text.txt{,}{,}Mijnwerker{;}CreateFile{,}text2.txt{,}{,}Mijnwerker")
-			for _, v := range s {
-				println(v["op"], v["filename"], v["content"])
-			}
-		} else if strings.Contains(text, "treetest") == true {
-			b := Block{root.hashvalue, 0, 0, 65535, "Miner", "A,B,C,D"}
-			b1 := Block{minerChain.hashBlock(&b), 0, 0, 1234, "ad", "C,D"}
-			b2 := Block{minerChain.hashBlock(&b), 0, 0, 1234, "ad", "C,D"}
-			c := Block{root.hashvalue, 0, 0, 1234, "ad", "C,D"}
-			d := Block{minerChain.hashBlock(&c), 0, 0, 1234, "ad", "C,D"}
-			root.addChild(b)
-			root.addChild(b1)
-			root.addChild(b2)
-			root.addChild(c)
-			root.addChild(d)
-			root.printTree()
+		} else if strings.Contains(text, "peers") == true {
+			printPeers()
+		} else if strings.Contains(text, "hashrate") == true {
+			fmt.Printf("%.0f hashes/s on %d workers\n", hashRate(), miningWorkers())
 		} else if strings.Contains(text, "tree") == true {
 			root.printTree()
 		} else if strings.Contains(text, "noop") == true {
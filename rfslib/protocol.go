@@ -0,0 +1,129 @@
+package rfslib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <WIRE PROTOCOL>
+
+// Messages between rfslib and the miner are frames of
+// [4 bytes big endian length][json of a Request or a Reply].
+// Every request carries an ID which the miner copies into its reply.
+
+// Version of the wire protocol, a miner refuses requests of another version
+const ProtocolVersion = 2
+
+// Largest frame accepted by either side
+const MaxFrameSize = 1 << 20
+
+// ErrorCode tells the client which error the miner ran into
+type ErrorCode int
+
+const (
+	CodeOK ErrorCode = iota
+	CodeBadRequest
+	CodeBadVersion
+	CodeNoPeers
+	CodeFileExists
+	CodeFileDoesNotExist
+	CodeRecordDoesNotExist
+	CodeFileMaxLenReached
+	CodeBadFilename
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeOK:
+		return "OK"
+	case CodeBadRequest:
+		return "BadRequest"
+	case CodeBadVersion:
+		return "BadVersion"
+	case CodeNoPeers:
+		return "NoPeers"
+	case CodeFileExists:
+		return "FileExists"
+	case CodeFileDoesNotExist:
+		return "FileDoesNotExist"
+	case CodeRecordDoesNotExist:
+		return "RecordDoesNotExist"
+	case CodeFileMaxLenReached:
+		return "FileMaxLenReached"
+	case CodeBadFilename:
+		return "BadFilename"
+	}
+	return fmt.Sprintf("ErrorCode(%d)", int(c))
+}
+
+// Request is sent by rfslib to the miner
+type Request struct {
+	Version   int
+	ID        uint64
+	Op        string // CreateFile, queryFile, ListFiles, TotalRecs, ReadRec, ReadRecs or AppendRec
+	Name      string
+	RecordNum uint16 // ReadRec: the record, ReadRecs: the first record
+	Count     uint16 // ReadRecs: how many records
+	Record    []byte // base64 in json, keeps every byte of the record
+	MinerID   string // queryFile: the miner that accepted the CreateFile
+	OpID      string // queryFile: id of the CreateFile operation
+}
+
+// Reply is the answer of the miner to the request with the same ID
+type Reply struct {
+	Version   int
+	ID        uint64
+	Code      ErrorCode
+	Message   string
+	OpID      string   // CreateFile: id of the operation
+	Interval  int      // CreateFile: seconds between two queryFile
+	MinerID   string   // CreateFile: the miner that accepted the operation
+	Confirmed bool     // queryFile: the CreateFile has enough confirmations
+	Files     []string // ListFiles
+	NumRecs   uint16   // TotalRecs, AppendRec: position of the new record
+	Record    []byte   // ReadRec
+	Records   [][]byte // ReadRecs
+	More      bool     // ReadRecs: the file has records after the last one in Records
+}
+
+// Most records the miner puts into one ReadRecs reply, keeps the reply below MaxFrameSize
+const MaxRecordsPerReply = 1024
+
+// WriteFrame writes v as one length-prefixed json frame
+func WriteFrame(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxFrameSize {
+		return fmt.Errorf("RFS: frame of %d bytes is too large", len(data))
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(data)))
+	copy(frame[4:], data)
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadFrame reads one length-prefixed json frame into v
+func ReadFrame(r io.Reader, v interface{}) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length > MaxFrameSize {
+		return fmt.Errorf("RFS: frame of %d bytes is too large", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// </WIRE PROTOCOL>
+////////////////////////////////////////////////////////////////////////////////////////////
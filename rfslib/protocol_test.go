@@ -0,0 +1,54 @@
+package rfslib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	record := testRecord()
+	client, miner := net.Pipe()
+	defer client.Close()
+	defer miner.Close()
+
+	sent := Request{Version: ProtocolVersion, ID: 7, Op: "AppendRec", Name: "f", Record: record[:]}
+	errs := make(chan error, 1)
+	go func() { errs <- WriteFrame(client, &sent) }()
+
+	var got Request
+	if err := ReadFrame(miner, &got); err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+	if got.ID != 7 || got.Op != "AppendRec" || got.Name != "f" {
+		t.Fatalf("got request %+v", got)
+	}
+	if !bytes.Equal(got.Record, record[:]) {
+		t.Fatalf("record of %d bytes came back changed", len(got.Record))
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	request := Request{Name: strings.Repeat("a", MaxFrameSize)}
+	if err := WriteFrame(&buf, &request); err == nil {
+		t.Fatal("frame over MaxFrameSize was written")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes written for a refused frame", buf.Len())
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], MaxFrameSize+1)
+	var reply Reply
+	if err := ReadFrame(bytes.NewReader(header[:]), &reply); err == nil {
+		t.Fatal("length over MaxFrameSize was accepted")
+	}
+}
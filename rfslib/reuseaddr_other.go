@@ -0,0 +1,8 @@
+//go:build !unix
+
+package rfslib
+
+import "syscall"
+
+// reuseAddr : SO_REUSEADDR is only set on unix
+var reuseAddr func(network, address string, c syscall.RawConn) error
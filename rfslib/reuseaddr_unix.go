@@ -0,0 +1,17 @@
+//go:build unix
+
+package rfslib
+
+import "syscall"
+
+// reuseAddr lets the client bind the port of localAddr while the connection of its
+// previous run is still in TIME_WAIT
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
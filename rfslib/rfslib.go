@@ -11,10 +11,11 @@ it.
 package rfslib
 
 import (
+	"errors"
 	"fmt"
 	"net"
-	"strconv"
-	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -75,34 +76,25 @@ func (e FileMaxLenReachedError) Error() string {
 	return fmt.Sprintf("RFS: File [%s] has reached its maximum length", string(e))
 }
 
-func json(op string, name string, content string) string {
-	if content == "nil" {
-		content = "null"
-	}
-	if name == "nil" {
-		name = "null"
+// error of the API call that matches the error code in the reply
+func replyError(reply *Reply, minerAddr string, fname string, recordNum uint16) error {
+	switch reply.Code {
+	case CodeOK:
+		return nil
+	case CodeNoPeers:
+		return DisconnectedError(minerAddr)
+	case CodeFileExists:
+		return FileExistsError(fname)
+	case CodeFileDoesNotExist:
+		return FileDoesNotExistError(fname)
+	case CodeRecordDoesNotExist:
+		return RecordDoesNotExistError(recordNum)
+	case CodeFileMaxLenReached:
+		return FileMaxLenReachedError(fname)
+	case CodeBadFilename:
+		return BadFilenameError(fname)
 	}
-	res := "{\"op\":\"" + op + "\",\"name\":\"" + name + "\",\"content\":\"" + content + "\"}"
-	// println(res)
-	return res
-}
-
-func sendTCP(remoteIPPort string, content string) (string, error) {
-	conn, err := net.Dial("tcp", remoteIPPort)
-	defer conn.Close() /// wait
-	if err != nil {
-		return "", DisconnectedError(remoteIPPort)
-	}
-
-	conn.Write([]byte(content))
-	buf := make([]byte, 1024)
-	c, err := conn.Read(buf)
-	if err != nil {
-		return "", DisconnectedError(remoteIPPort)
-	}
-	// fmt.Println("Reply:", string(buf[0:c]))
-
-	return string(buf[0:c]), nil
+	return fmt.Errorf("RFS: miner [%s] replied %v: %s", minerAddr, reply.Code, reply.Message)
 }
 
 // </ERROR DEFINITIONS>
@@ -143,6 +135,16 @@ type RFS interface {
 	// - RecordDoesNotExistError (indicates record at this position has not been appended yet)
 	ReadRec(fname string, recordNum uint16, record *Record) (err error)
 
+	// Reads up to count consecutive records of file fname starting
+	// at position start. Fewer than count records are returned when
+	// the file ends before start+count.
+	//
+	// Can return the following errors:
+	// - DisconnectedError
+	// - FileDoesNotExistError
+	// - RecordDoesNotExistError (indicates there is no record at position start)
+	ReadRecs(fname string, start uint16, count uint16) (records []Record, err error)
+
 	// Appends a new record to a file with name fname with the
 	// contents pointed to by record. Returns the position of the
 	// record that was just appended as recordNum. Returns a non-nil
@@ -155,76 +157,210 @@ type RFS interface {
 	AppendRec(fname string, record *Record) (recordNum uint16, err error)
 }
 
+// RFSInstance shares one connection to the miner between all the calls,
+// the replies are matched to the requests by their ID
 type RFSInstance struct {
 	localAddr string
 	minerAddr string
+
+	mutex      sync.Mutex // protects conn, pending and nextID
+	writeMutex sync.Mutex // one frame at a time on conn
+	conn       net.Conn
+	pending    map[uint64]*call
+	nextID     uint64
+}
+
+// How often a broken connection is dialed again before giving up
+const reconnectAttempts = 3
+const reconnectDelay = 200 * time.Millisecond
+
+// a request waiting for its reply on conn, done gets nil if conn breaks first
+type call struct {
+	conn net.Conn
+	done chan *Reply
+}
+
+// operations the miner may safely see twice, so they are sent again after a reconnect
+func idempotent(op string) bool {
+	return op != "CreateFile" && op != "AppendRec"
+}
+
+// the local port is still held by an earlier connection
+func addrInUse(err error) bool {
+	return err != nil && (errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL))
+}
+
+// dial the miner from localAddr. The earlier connection from its port may take a moment
+// to close, so a busy port is tried a few times. When reconnecting and the port is
+// still held by the broken connection, only the IP of localAddr is kept.
+func (f *RFSInstance) dial(reconnect bool) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: 5 * time.Second, Control: reuseAddr}
+	if f.localAddr == "" {
+		return dialer.Dial("tcp", f.minerAddr)
+	}
+	addr, err := net.ResolveTCPAddr("tcp", f.localAddr)
+	if err != nil {
+		return nil, err
+	}
+	dialer.LocalAddr = addr
+	conn, err := dialer.Dial("tcp", f.minerAddr)
+	for attempt := 1; attempt < reconnectAttempts && addrInUse(err); attempt++ {
+		time.Sleep(reconnectDelay << uint(attempt))
+		conn, err = dialer.Dial("tcp", f.minerAddr)
+	}
+	if reconnect && addrInUse(err) {
+		dialer.LocalAddr = &net.TCPAddr{IP: addr.IP, Zone: addr.Zone}
+		conn, err = dialer.Dial("tcp", f.minerAddr)
+	}
+	return conn, err
+}
+
+// connection returns the shared connection, dialing again if it broke.
+// The caller holds f.mutex.
+func (f *RFSInstance) connection() (net.Conn, error) {
+	if f.conn != nil {
+		return f.conn, nil
+	}
+	for attempt := 0; attempt < reconnectAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(reconnectDelay << uint(attempt))
+		}
+		conn, err := f.dial(true)
+		if err == nil {
+			f.conn = conn
+			go f.readReplies(conn)
+			return conn, nil
+		}
+	}
+	return nil, DisconnectedError(f.minerAddr)
+}
+
+// readReplies hands every reply on conn to the request with the same ID
+func (f *RFSInstance) readReplies(conn net.Conn) {
+	for {
+		reply := &Reply{}
+		if err := ReadFrame(conn, reply); err != nil {
+			f.broken(conn)
+			return
+		}
+		f.mutex.Lock()
+		c, ok := f.pending[reply.ID]
+		delete(f.pending, reply.ID)
+		f.mutex.Unlock()
+		if ok {
+			c.done <- reply
+		}
+	}
+}
+
+// broken drops conn and wakes up the requests still waiting on it
+func (f *RFSInstance) broken(conn net.Conn) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.conn == conn {
+		f.conn = nil
+	}
+	conn.Close()
+	for id, c := range f.pending {
+		if c.conn == conn {
+			close(c.done)
+			delete(f.pending, id)
+		}
+	}
+}
+
+// send the request on the shared connection and wait for the reply with the same ID.
+// A request that could not be written, or an idempotent one whose connection broke
+// before the reply came back, is sent once more on a new connection.
+func (f *RFSInstance) send(request Request) (*Reply, error) {
+	request.Version = ProtocolVersion
+	for attempt := 0; attempt < 2; attempt++ {
+		f.mutex.Lock()
+		conn, err := f.connection()
+		if err != nil {
+			f.mutex.Unlock()
+			return nil, err
+		}
+		f.nextID++
+		request.ID = f.nextID
+		c := &call{conn, make(chan *Reply, 1)}
+		f.pending[request.ID] = c
+		f.mutex.Unlock()
+
+		f.writeMutex.Lock()
+		err = WriteFrame(conn, &request)
+		f.writeMutex.Unlock()
+		if err != nil {
+			f.broken(conn)
+			continue
+		}
+		if reply := <-c.done; reply != nil {
+			return reply, nil
+		}
+		if !idempotent(request.Op) {
+			break
+		}
+	}
+	return nil, DisconnectedError(f.minerAddr)
 }
 
 // Can return the following errors:
 // - DisconnectedError
 // - FileExistsError
 // - BadFilenameError
-func (f RFSInstance) CreateFile(fname string) (err error) {
+func (f *RFSInstance) CreateFile(fname string) (err error) {
 	if len(fname) > 64 {
 		return BadFilenameError(fname)
 	}
-	reply, err := sendTCP(f.minerAddr, json("CreateFile", fname, "nil"))
+	reply, err := f.send(Request{Op: "CreateFile", Name: fname})
 	if err != nil {
 		return err
 	}
-	if reply == "AllDisconnectedPeers" {
-		fmt.Println(reply)
-		return DisconnectedError("miner does not have peers")
-	}
-	if reply == "FileExistsError" {
-		return FileExistsError(fname)
+	if err := replyError(reply, f.minerAddr, fname, 0); err != nil {
+		return err
 	}
-	replylist := strings.Split(reply, ";")
-	timeInterval, _ := strconv.Atoi(replylist[1])
-	minerID := replylist[2]
+	minerID, opID := reply.MinerID, reply.OpID
 
-	ticker := time.NewTicker(time.Duration(timeInterval) * time.Second)
+	ticker := time.NewTicker(time.Duration(reply.Interval) * time.Second)
+	defer ticker.Stop()
 	for range ticker.C {
 		// to check whether the file has been comfirmed
-		ack, err := sendTCP(f.minerAddr, json("queryFile", "CreateFile{,}"+fname, minerID))
+		ack, err := f.send(Request{Op: "queryFile", Name: fname, MinerID: minerID, OpID: opID})
 		if err != nil {
 			return err
 		}
-		if ack == "wait" {
-			println("conforming...")
-		} else if ack == "true" {
+		if err := replyError(ack, f.minerAddr, fname, 0); err != nil {
+			return err
+		}
+		if ack.Confirmed {
 			return nil
-		} else {
-			return FileExistsError(fname)
 		}
-		// perform any
+		println("conforming...")
 	}
 
 	return err
 }
 
-func (f RFSInstance) ListFiles() ([]string, error) {
-	reply, err := sendTCP(f.minerAddr, json("ListFiles", "nil", "nil"))
+func (f *RFSInstance) ListFiles() ([]string, error) {
+	reply, err := f.send(Request{Op: "ListFiles"})
 	if err != nil {
 		return nil, err
 	}
-	if len(reply) == 0 {
-		return nil, nil
+	if err := replyError(reply, f.minerAddr, "", 0); err != nil {
+		return nil, err
 	}
-	list := strings.Split(reply, ";")
-	return list, err
+	return reply.Files, nil
 }
 
-func (f RFSInstance) TotalRecs(fname string) (numRecs uint16, err error) {
-	reply, err := sendTCP(f.minerAddr, json("TotalRecs", fname, "nil"))
+func (f *RFSInstance) TotalRecs(fname string) (numRecs uint16, err error) {
+	reply, err := f.send(Request{Op: "TotalRecs", Name: fname})
 	if err != nil {
 		return 0, err
 	}
-	if reply == "FileDoesNotExistError" {
-		return 0, FileDoesNotExistError(fname)
+	if err := replyError(reply, f.minerAddr, fname, 0); err != nil {
+		return 0, err
 	}
-	l, _ := strconv.Atoi(reply)
-	return uint16(l), err
+	return reply.NumRecs, nil
 }
 
 // Reads a record from file fname at position recordNum into
@@ -235,18 +371,54 @@ func (f RFSInstance) TotalRecs(fname string) (numRecs uint16, err error) {
 // - DisconnectedError
 // - FileDoesNotExistError
 // - RecordDoesNotExistError (indicates record at this position has not been appended yet)
-func (f RFSInstance) ReadRec(fname string, recordNum uint16, record *Record) (err error) {
-	reply, err := sendTCP(f.minerAddr, json("ReadRec", fname, strconv.Itoa(int(recordNum))))
+func (f *RFSInstance) ReadRec(fname string, recordNum uint16, record *Record) (err error) {
+	reply, err := f.send(Request{Op: "ReadRec", Name: fname, RecordNum: recordNum})
 	if err != nil {
 		return err
-	} else if reply == "FileDoesNotExistError" {
-		return FileDoesNotExistError(fname)
-	} else if reply == "RecordDoesNotExistError" {
-		return RecordDoesNotExistError(recordNum)
-	} else {
-		copy((*record)[:], reply)
 	}
-	return err
+	if err := replyError(reply, f.minerAddr, fname, recordNum); err != nil {
+		return err
+	}
+	*record = Record{}
+	copy((*record)[:], reply.Record)
+	return nil
+}
+
+// Reads up to count consecutive records of file fname starting
+// at position start. The miner caps the number of records in one
+// reply, so larger ranges take several requests.
+//
+// Can return the following errors:
+// - DisconnectedError
+// - FileDoesNotExistError
+// - RecordDoesNotExistError (indicates there is no record at position start)
+func (f *RFSInstance) ReadRecs(fname string, start uint16, count uint16) (records []Record, err error) {
+	records = make([]Record, 0, count)
+	for len(records) < int(count) {
+		pos := int(start) + len(records)
+		if pos > 65535 {
+			break
+		}
+		reply, err := f.send(Request{Op: "ReadRecs", Name: fname, RecordNum: uint16(pos), Count: count - uint16(len(records))})
+		if err != nil {
+			return nil, err
+		}
+		if err := replyError(reply, f.minerAddr, fname, uint16(pos)); err != nil {
+			if len(records) > 0 && reply.Code == CodeRecordDoesNotExist {
+				break // the file ended exactly at the end of the previous reply
+			}
+			return nil, err
+		}
+		for _, data := range reply.Records {
+			var record Record
+			copy(record[:], data)
+			records = append(records, record)
+		}
+		if !reply.More {
+			break
+		}
+	}
+	return records, nil
 }
 
 // Appends a new record to a file with name fname with the
@@ -258,29 +430,15 @@ func (f RFSInstance) ReadRec(fname string, recordNum uint16, record *Record) (er
 // - DisconnectedError
 // - FileDoesNotExistError
 // - FileMaxLenReachedError
-func (f RFSInstance) AppendRec(fname string, record *Record) (recordNum uint16, err error) {
-	m := [512]byte(*record)
-	var i int
-	for i = 0; i < 512; i++ {
-		if m[i] == 0 { // json can't have \x00, so we need to find the end of the record and discard all \x00
-			break // e.g. the record is ['a','b',0,0,0,0,0,...,0,0,0],we only send "ab" as string
-		}
-	}
-	content := string(m[0:i])
-	reply, err := sendTCP(f.minerAddr, json("AppendRec", fname, string(content)))
+func (f *RFSInstance) AppendRec(fname string, record *Record) (recordNum uint16, err error) {
+	reply, err := f.send(Request{Op: "AppendRec", Name: fname, Record: record[:]})
 	if err != nil {
 		return 0, err
 	}
-	if reply == "AllDisconnectedPeers" {
-		return 0,DisconnectedError("miner does not have peers")
-	}
-	if reply == "FileDoesNotExistError" {
-		return 0, FileDoesNotExistError(fname)
-	} else if reply == "FileMaxLenReachedError" {
-		return 0, FileMaxLenReachedError(fname)
+	if err := replyError(reply, f.minerAddr, fname, 0); err != nil {
+		return 0, err
 	}
-	l, _ := strconv.Atoi(reply)
-	return uint16(l), err
+	return reply.NumRecs, nil
 }
 
 // The constructor for a new RFS object instance. Takes the miner's
@@ -294,13 +452,18 @@ func (f RFSInstance) AppendRec(fname string, record *Record) (recordNum uint16,
 // succeeds. This call can return the following errors:
 // - Networking errors related to localAddr or minerAddr
 func Initialize(localAddr string, minerAddr string) (rfs RFS, err error) {
-	// TODO
-	// For now return a DisconnectedError
-	conn, err := net.Dial("tcp", minerAddr)
+	f := &RFSInstance{localAddr: localAddr, minerAddr: minerAddr, pending: make(map[uint64]*call)}
+	if localAddr != "" {
+		if _, err := net.ResolveTCPAddr("tcp", localAddr); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := f.dial(false)
 	if err != nil {
-		return nil, DisconnectedError(minerAddr)
+		return nil, err
 	}
-	defer conn.Close() /// wait
+	f.conn = conn
+	go f.readReplies(conn)
 
-	return RFSInstance{localAddr, minerAddr}, nil
+	return f, nil
 }
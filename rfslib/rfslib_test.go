@@ -0,0 +1,110 @@
+package rfslib
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// a record with zeros in the middle and at the end, every byte must survive the trip
+func testRecord() Record {
+	var record Record
+	copy(record[:], "head")
+	copy(record[200:], "\x00\x00middle\x00")
+	record[510] = 0xff
+	return record
+}
+
+// an RFSInstance talking to a fake miner over a pipe, the returned conn is the miner's end
+func pipeInstance() (*RFSInstance, net.Conn) {
+	client, miner := net.Pipe()
+	f := &RFSInstance{minerAddr: "pipe", conn: client, pending: make(map[uint64]*call)}
+	go f.readReplies(client)
+	return f, miner
+}
+
+func TestRecordThroughMiner(t *testing.T) {
+	record := testRecord()
+	f, miner := pipeInstance()
+	defer miner.Close()
+
+	// the fake miner keeps the appended record and hands it back on ReadRec
+	go func() {
+		var stored []byte
+		for {
+			var request Request
+			if err := ReadFrame(miner, &request); err != nil {
+				return
+			}
+			reply := Reply{Version: ProtocolVersion, ID: request.ID}
+			switch request.Op {
+			case "AppendRec":
+				stored = request.Record
+			case "ReadRec":
+				reply.Record = stored
+			}
+			if err := WriteFrame(miner, &reply); err != nil {
+				return
+			}
+		}
+	}()
+
+	if _, err := f.AppendRec("f", &record); err != nil {
+		t.Fatalf("AppendRec: %v", err)
+	}
+	var read Record
+	if err := f.ReadRec("f", 0, &read); err != nil {
+		t.Fatalf("ReadRec: %v", err)
+	}
+	if read != record {
+		t.Fatal("record read back differs from the appended one")
+	}
+}
+
+func TestRepliesMatchedByID(t *testing.T) {
+	f, miner := pipeInstance()
+	defer miner.Close()
+
+	// the fake miner answers two requests in the opposite order,
+	// each reply names the record its request asked for
+	go func() {
+		var requests [2]Request
+		for i := range requests {
+			if err := ReadFrame(miner, &requests[i]); err != nil {
+				return
+			}
+		}
+		for i := len(requests) - 1; i >= 0; i-- {
+			reply := Reply{Version: ProtocolVersion, ID: requests[i].ID, NumRecs: requests[i].RecordNum}
+			if err := WriteFrame(miner, &reply); err != nil {
+				return
+			}
+		}
+	}()
+
+	type result struct {
+		asked uint16
+		reply *Reply
+		err   error
+	}
+	results := make(chan result, 2)
+	for _, num := range []uint16{1, 2} {
+		go func(num uint16) {
+			reply, err := f.send(Request{Op: "TotalRecs", RecordNum: num})
+			results <- result{num, reply, err}
+		}(num)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				t.Fatalf("send: %v", r.err)
+			}
+			if r.reply.NumRecs != r.asked {
+				t.Fatalf("request for %d got the reply for %d", r.asked, r.reply.NumRecs)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reply")
+		}
+	}
+}
@@ -55,12 +55,15 @@ func main() {
 		log.Fatal("Failed to obtain total number of records for file: ", fname)
 	}
 
-	for i := max(0, int(num_recs)-k); i < int(num_recs); i++ {
-		var record rfslib.Record
-		err := rfs.ReadRec(fname, uint16(i), &record)
-		if err != nil {
-			log.Fatalf("Failed to obtain record %d for %s\n", i, fname)
-		}
+	start := max(0, int(num_recs)-k)
+	if start >= int(num_recs) {
+		return
+	}
+	records, err := rfs.ReadRecs(fname, uint16(start), num_recs-uint16(start))
+	if err != nil {
+		log.Fatalf("Failed to obtain records %d to %d for %s\n", start, num_recs-1, fname)
+	}
+	for _, record := range records {
 		fmt.Println(string(record[:]))
 	}
 }